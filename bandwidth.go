@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/bwlimit"
+)
+
+// global limiters, and per client limiters by User-Agent match
+var (
+	uploadLimit   = bwlimit.New(0)
+	downloadLimit = bwlimit.New(0)
+	clientLimits  = make(map[string]*clientLimit)
+	bandwidthL    sync.Mutex
+
+	// limits set at runtime through /_bandwidth, which win over the
+	// configuration and schedule until cleared, by client match ("" for
+	// global limits)
+	bandwidthOverrides = make(map[string]*bandwidthOverride)
+)
+
+type clientLimit struct {
+	upload, download *bwlimit.Limiter
+}
+
+// bandwidthOverride holds limits set at runtime, -1 when not set
+type bandwidthOverride struct {
+	upload, download int64
+}
+
+// apply returns up and down, replaced by the limits set in o
+func (o *bandwidthOverride) apply(up, down int64) (int64, int64) {
+	if o == nil {
+		return up, down
+	}
+	if o.upload >= 0 {
+		up = o.upload
+	}
+	if o.download >= 0 {
+		down = o.download
+	}
+	return up, down
+}
+
+// match returns true if the rule applies at time t
+func (r *BandwidthRule) match(t time.Time) bool {
+	if len(r.Days) > 0 {
+		day := strings.ToLower(t.Weekday().String()[:3])
+		found := false
+		for _, d := range r.Days {
+			if strings.ToLower(d) == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	from, err1 := parseClock(r.From)
+	to, err2 := parseClock(r.To)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return m >= from && m < to
+	}
+	// overnight
+	return m >= from || m < to
+}
+
+// parseClock parses HH:MM into minutes since midnight
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// applyBandwidth sets limiters rates according to configuration at time t
+func applyBandwidth(t time.Time) {
+	bandwidthL.Lock()
+	defer bandwidthL.Unlock()
+
+	c := &config.Bandwidth
+	up, down := c.Upload, c.Download
+	for i := range c.Schedule {
+		if c.Schedule[i].match(t) {
+			up, down = c.Schedule[i].Upload, c.Schedule[i].Download
+			break
+		}
+	}
+	up, down = bandwidthOverrides[""].apply(up, down)
+	uploadLimit.SetRate(up)
+	downloadLimit.SetRate(down)
+
+	for _, cl := range c.Clients {
+		l, ok := clientLimits[cl.Match]
+		if !ok {
+			l = &clientLimit{upload: bwlimit.New(0), download: bwlimit.New(0)}
+			clientLimits[cl.Match] = l
+		}
+		up, down := bandwidthOverrides[cl.Match].apply(cl.Upload, cl.Download)
+		l.upload.SetRate(up)
+		l.download.SetRate(down)
+	}
+}
+
+// startBandwidth applies limits and keeps following the schedule
+func startBandwidth() {
+	applyBandwidth(time.Now())
+	go func() {
+		for range time.Tick(30 * time.Second) {
+			applyBandwidth(time.Now())
+		}
+	}()
+}
+
+// requestLimiters returns limiters applying to the client that made the
+// request in ctx, global limiter first
+func requestLimiters(ctx context.Context) (up, down []*bwlimit.Limiter) {
+	return clientLimiters(requestClient(ctx))
+}
+
+// requestClient returns the match of the client limits applying to the
+// request in ctx, or "" if none
+func requestClient(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	r := requestFromContext(ctx)
+	if r == nil {
+		return ""
+	}
+	ua := r.Header.Get("User-Agent")
+
+	bandwidthL.Lock()
+	defer bandwidthL.Unlock()
+	for _, cl := range config.Bandwidth.Clients {
+		if cl.Match != "" && strings.Contains(ua, cl.Match) {
+			return cl.Match
+		}
+	}
+	return ""
+}
+
+// clientLimiters returns limiters applying to client, as returned by
+// requestClient, global limiter first
+func clientLimiters(client string) (up, down []*bwlimit.Limiter) {
+	up = []*bwlimit.Limiter{uploadLimit}
+	down = []*bwlimit.Limiter{downloadLimit}
+
+	bandwidthL.Lock()
+	defer bandwidthL.Unlock()
+	if l, ok := clientLimits[client]; ok && client != "" {
+		up = append(up, l.upload)
+		down = append(down, l.download)
+	}
+	return
+}
+
+// withLimiters returns a context carrying download limiters
+func withLimiters(ctx context.Context, l []*bwlimit.Limiter) context.Context {
+	return context.WithValue(ctx, ctxKeyLimiters, l)
+}
+
+func limitersFromContext(ctx context.Context) []*bwlimit.Limiter {
+	l, ok := ctx.Value(ctxKeyLimiters).([]*bwlimit.Limiter)
+	if !ok {
+		return []*bwlimit.Limiter{downloadLimit}
+	}
+	return l
+}
+
+// serveBandwidth shows current limits, and allows changing them with
+// upload= and download= parameters in a POST request: bytes per second (0 =
+// unlimited), or "auto" to go back to the configuration and schedule. With
+// client=, limits of the configured client with that match are changed
+// instead of the global ones.
+func serveBandwidth(w http.ResponseWriter, r *http.Request) {
+	if (r.FormValue("upload") != "" || r.FormValue("download") != "") && !controlAllowed(w, r) {
+		return
+	}
+	client := r.FormValue("client")
+	changed := false
+	bandwidthL.Lock()
+	if client != "" {
+		if _, ok := clientLimits[client]; !ok {
+			bandwidthL.Unlock()
+			http.Error(w, "unknown client "+client, http.StatusBadRequest)
+			return
+		}
+	}
+	o := bandwidthOverrides[client]
+	if o == nil {
+		o = &bandwidthOverride{upload: -1, download: -1}
+	}
+	next := *o
+	for _, k := range []string{"upload", "download"} {
+		v := r.FormValue(k)
+		if v == "" {
+			continue
+		}
+		rate := int64(-1)
+		if v != "auto" {
+			var err error
+			rate, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || rate < 0 {
+				bandwidthL.Unlock()
+				http.Error(w, "invalid value for "+k, http.StatusBadRequest)
+				return
+			}
+		}
+		if k == "upload" {
+			next.upload = rate
+		} else {
+			next.download = rate
+		}
+		changed = true
+	}
+	if changed && next.upload < 0 && next.download < 0 {
+		delete(bandwidthOverrides, client)
+	} else if changed {
+		bandwidthOverrides[client] = &next
+	}
+	bandwidthL.Unlock()
+	if changed {
+		applyBandwidth(time.Now())
+	}
+
+	bandwidthStatus(w)
+}
+
+func bandwidthStatus(w io.Writer) {
+	rate := func(r int64) string {
+		if r <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d bytes/s", r)
+	}
+
+	// marks limits set at runtime
+	set := func(client string) string {
+		if _, ok := bandwidthOverrides[client]; ok {
+			return " (set at runtime)"
+		}
+		return ""
+	}
+
+	bandwidthL.Lock()
+	defer bandwidthL.Unlock()
+	fmt.Fprintf(w, "upload: %s\ndownload: %s%s\n", rate(uploadLimit.Rate()), rate(downloadLimit.Rate()), set(""))
+	for _, cl := range config.Bandwidth.Clients {
+		l := clientLimits[cl.Match]
+		fmt.Fprintf(w, "client %q: upload %s, download %s%s\n", cl.Match, rate(l.upload.Rate()), rate(l.download.Rate()), set(cl.Match))
+	}
+}
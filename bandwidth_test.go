@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthOverride(t *testing.T) {
+	defer func(c BandwidthConfig) {
+		config.Bandwidth = c
+		bandwidthOverrides = make(map[string]*bandwidthOverride)
+		applyBandwidth(time.Now())
+	}(config.Bandwidth)
+	config.Bandwidth = BandwidthConfig{
+		Upload:   1000,
+		Schedule: []BandwidthRule{{From: "09:00", To: "18:00", Upload: 500}},
+		Clients:  []BandwidthClient{{Match: "Tool", Upload: 100}},
+	}
+	noon := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+
+	post := func(query string) {
+		w := httptest.NewRecorder()
+		serveBandwidth(w, httptest.NewRequest("POST", "http://localhost:50500/_bandwidth?"+query, nil))
+		if w.Code != 200 {
+			body, _ := ioutil.ReadAll(w.Body)
+			t.Fatalf("%s: %d %s", query, w.Code, body)
+		}
+	}
+	check := func(what string, up, client int64) {
+		t.Helper()
+		applyBandwidth(noon) // as done by the schedule
+		if uploadLimit.Rate() != up || clientLimits["Tool"].upload.Rate() != client {
+			t.Errorf("%s: upload limits %d and %d, want %d and %d", what, uploadLimit.Rate(), clientLimits["Tool"].upload.Rate(), up, client)
+		}
+	}
+
+	check("schedule", 500, 100)
+	post("upload=2000")
+	check("runtime limit", 2000, 100)
+	post("client=Tool&upload=0")
+	check("runtime client limit", 2000, 0)
+	post("upload=auto")
+	check("cleared limit", 500, 0)
+	post("client=Tool&upload=auto")
+	check("cleared client limit", 500, 100)
+
+	if up, _ := clientLimiters("Tool"); len(up) != 2 || up[1] != clientLimits["Tool"].upload {
+		t.Errorf("client limiter not applied")
+	}
+}
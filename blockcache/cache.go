@@ -0,0 +1,324 @@
+// Package blockcache stores blocks of immutable content on disk, keyed by
+// blob id and offset, with a size limit enforced by evicting the least
+// recently used blocks. Pinned blocks are never evicted and do not count
+// towards the limit.
+//
+// The filesystem itself holds all metadata: blocks are written to a
+// temporary file, synced and renamed in place, and the index is rebuilt from
+// the directory on startup using modification times as access times. A crash
+// can at worst lose recent access times, never return partial data.
+package blockcache
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/cfgpath"
+)
+
+type Cache struct {
+	dir     string
+	maxSize int64
+	size    int64
+
+	entries map[string]*list.Element
+	lru     *list.List       // front is most recently used
+	pinned  map[string]int64 // key → size
+	lk      sync.Mutex
+}
+
+const pinSuffix = ".pin"
+
+type entry struct {
+	key  string
+	size int64
+}
+
+// New opens the cache stored in dir, creating it if needed
+func New(dir string, maxSize int64) (*Cache, error) {
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pinned:  make(map[string]int64),
+	}
+	if err := cfgpath.EnsureDir(dir); err != nil {
+		return nil, err
+	}
+	if err := c.scan(); err != nil {
+		return nil, err
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// scan rebuilds the index from files found on disk
+func (c *Cache) scan() error {
+	type found struct {
+		key   string
+		size  int64
+		mtime time.Time
+	}
+	var list []found
+
+	err := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := info.Name()
+		if strings.HasPrefix(name, "tmp-") {
+			// leftover from an interrupted write
+			os.Remove(p)
+			return nil
+		}
+		list = append(list, found{key: name, size: info.Size(), mtime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// oldest first, so that the most recent ends up at the front
+	sort.Slice(list, func(i, j int) bool { return list[i].mtime.Before(list[j].mtime) })
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	for _, f := range list {
+		if strings.HasSuffix(f.key, pinSuffix) {
+			c.pinned[strings.TrimSuffix(f.key, pinSuffix)] = f.size
+			continue
+		}
+		c.entries[f.key] = c.lru.PushFront(&entry{key: f.key, size: f.size})
+		c.size += f.size
+	}
+	if len(list) > 0 {
+		log.Printf("[cache] found %d blocks (%d bytes), %d pinned", len(c.entries), c.size, len(c.pinned))
+	}
+	return nil
+}
+
+func key(blob string, off int64) string {
+	h := sha1.Sum([]byte(fmt.Sprintf("%s:%d", blob, off)))
+	return hex.EncodeToString(h[:])
+}
+
+func (c *Cache) path(k string) string {
+	return filepath.Join(c.dir, k[:2], k)
+}
+
+// Get returns the block of length l at offset off of blob, if cached
+func (c *Cache) Get(blob string, off, l int64) ([]byte, bool) {
+	k := key(blob, off)
+
+	c.lk.Lock()
+	e, ok := c.entries[k]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	_, pinned := c.pinned[k]
+	c.lk.Unlock()
+
+	if pinned {
+		data, err := ioutil.ReadFile(c.path(k) + pinSuffix)
+		if err == nil && int64(len(data)) == l {
+			return data, true
+		}
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	p := c.path(k)
+	data, err := ioutil.ReadFile(p)
+	if err != nil || int64(len(data)) != l {
+		// missing or not matching what we expect (block size changed?)
+		c.lk.Lock()
+		c.remove(k)
+		c.lk.Unlock()
+		return nil, false
+	}
+
+	// keep track of access time on disk
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+// Put stores a block in the cache
+func (c *Cache) Put(blob string, off int64, data []byte) error {
+	k := key(blob, off)
+	p := c.path(k)
+
+	c.lk.Lock()
+	_, ok := c.entries[k]
+	_, pinned := c.pinned[k]
+	c.lk.Unlock()
+	if ok || pinned {
+		return nil
+	}
+
+	if err := cfgpath.EnsureDir(filepath.Dir(p)); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), "tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if _, ok := c.entries[k]; !ok {
+		c.entries[k] = c.lru.PushFront(&entry{key: k, size: int64(len(data))})
+		c.size += int64(len(data))
+	}
+	c.evict()
+	return nil
+}
+
+// Has returns true if a block is in the cache
+func (c *Cache) Has(blob string, off int64) bool {
+	k := key(blob, off)
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	_, ok := c.entries[k]
+	_, pinned := c.pinned[k]
+	return ok || pinned
+}
+
+// Remove drops a block from the cache, if present, even if pinned
+func (c *Cache) Remove(blob string, off int64) {
+	k := key(blob, off)
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.remove(k)
+	if _, ok := c.pinned[k]; ok {
+		delete(c.pinned, k)
+		os.Remove(c.path(k) + pinSuffix)
+	}
+}
+
+// Pin protects a cached block from eviction. Returns false if the block is
+// not in the cache.
+func (c *Cache) Pin(blob string, off int64) bool {
+	k := key(blob, off)
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if _, ok := c.pinned[k]; ok {
+		return true
+	}
+	e, ok := c.entries[k]
+	if !ok {
+		return false
+	}
+	if err := os.Rename(c.path(k), c.path(k)+pinSuffix); err != nil {
+		return false
+	}
+	size := e.Value.(*entry).size
+	c.lru.Remove(e)
+	delete(c.entries, k)
+	c.size -= size
+	c.pinned[k] = size
+	return true
+}
+
+// Unpin makes a pinned block subject to eviction again
+func (c *Cache) Unpin(blob string, off int64) {
+	k := key(blob, off)
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	size, ok := c.pinned[k]
+	if !ok {
+		return
+	}
+	delete(c.pinned, k)
+	if err := os.Rename(c.path(k)+pinSuffix, c.path(k)); err != nil {
+		os.Remove(c.path(k) + pinSuffix)
+		return
+	}
+	// least recently used, since nobody asked for it
+	c.entries[k] = c.lru.PushBack(&entry{key: k, size: size})
+	c.size += size
+	c.evict()
+}
+
+// PinnedSize returns the total size of pinned blocks
+func (c *Cache) PinnedSize() int64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	var size int64
+	for _, s := range c.pinned {
+		size += s
+	}
+	return size
+}
+
+// SetMaxSize changes the size limit, evicting blocks if needed
+func (c *Cache) SetMaxSize(maxSize int64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.maxSize = maxSize
+	c.evict()
+}
+
+// Size returns the total size of cached blocks
+func (c *Cache) Size() int64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.size
+}
+
+// evict removes least recently used blocks until the cache fits its limit.
+// Must be called with lock held.
+func (c *Cache) evict() {
+	for c.size > c.maxSize {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		c.remove(e.Value.(*entry).key)
+	}
+}
+
+// remove drops a block. Must be called with lock held.
+func (c *Cache) remove(k string) {
+	e, ok := c.entries[k]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.entries, k)
+	c.size -= e.Value.(*entry).size
+	os.Remove(c.path(k))
+}
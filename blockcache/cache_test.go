@@ -0,0 +1,180 @@
+package blockcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempCache(t *testing.T, maxSize int64) (*Cache, string) {
+	dir, err := ioutil.TempDir("", "blockcache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(dir, maxSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+func block(b byte, l int) []byte {
+	return bytes.Repeat([]byte{b}, l)
+}
+
+func TestGetPut(t *testing.T) {
+	c, dir := tempCache(t, 1000)
+	defer os.RemoveAll(dir)
+
+	if _, ok := c.Get("blob", 0, 100); ok {
+		t.Fatal("empty cache returned a block")
+	}
+	if err := c.Put("blob", 0, block('a', 100)); err != nil {
+		t.Fatal(err)
+	}
+	data, ok := c.Get("blob", 0, 100)
+	if !ok || !bytes.Equal(data, block('a', 100)) {
+		t.Fatal("stored block not returned")
+	}
+	if _, ok := c.Get("blob", 0, 50); ok {
+		t.Error("block returned for a different length")
+	}
+	if _, ok := c.Get("blob", 100, 100); ok {
+		t.Error("block returned for a different offset")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c, dir := tempCache(t, 300)
+	defer os.RemoveAll(dir)
+
+	for i := int64(0); i < 3; i++ {
+		if err := c.Put("blob", i*100, block('a', 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// make block 0 the most recently used
+	if _, ok := c.Get("blob", 0, 100); !ok {
+		t.Fatal("block 0 missing")
+	}
+	if err := c.Put("blob", 300, block('a', 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Size() != 300 {
+		t.Errorf("size is %d, expected 300", c.Size())
+	}
+	if c.Has("blob", 100) {
+		t.Error("least recently used block was not evicted")
+	}
+	for _, off := range []int64{0, 200, 300} {
+		if !c.Has("blob", off) {
+			t.Errorf("block %d was evicted", off)
+		}
+	}
+}
+
+func TestSetMaxSize(t *testing.T) {
+	c, dir := tempCache(t, 1000)
+	defer os.RemoveAll(dir)
+
+	for i := int64(0); i < 5; i++ {
+		c.Put("blob", i*100, block('a', 100))
+	}
+	c.SetMaxSize(250)
+	if c.Size() > 250 {
+		t.Errorf("size is %d after lowering limit to 250", c.Size())
+	}
+	if !c.Has("blob", 400) || !c.Has("blob", 300) || c.Has("blob", 200) {
+		t.Error("wrong blocks evicted")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	c, dir := tempCache(t, 1000)
+	defer os.RemoveAll(dir)
+
+	c.Put("blob", 0, block('a', 100))
+	c.Put("blob", 100, block('b', 100))
+
+	c, err := New(dir, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() != 200 {
+		t.Errorf("size is %d after reopening, expected 200", c.Size())
+	}
+	data, ok := c.Get("blob", 100, 100)
+	if !ok || !bytes.Equal(data, block('b', 100)) {
+		t.Error("block lost after reopening")
+	}
+
+	// a lower limit is applied on open
+	c, err = New(dir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size() > 150 {
+		t.Errorf("size is %d after reopening with limit 150", c.Size())
+	}
+}
+
+func TestPin(t *testing.T) {
+	c, dir := tempCache(t, 200)
+	defer os.RemoveAll(dir)
+
+	if c.Pin("blob", 0) {
+		t.Fatal("pinned a block not in the cache")
+	}
+	c.Put("blob", 0, block('a', 100))
+	if !c.Pin("blob", 0) {
+		t.Fatal("failed to pin a cached block")
+	}
+	if c.Size() != 0 || c.PinnedSize() != 100 {
+		t.Errorf("pinned block counted in size (size %d, pinned %d)", c.Size(), c.PinnedSize())
+	}
+
+	// fill the cache, the pinned block stays
+	for i := int64(1); i < 5; i++ {
+		c.Put("blob", i*100, block('b', 100))
+	}
+	data, ok := c.Get("blob", 0, 100)
+	if !ok || !bytes.Equal(data, block('a', 100)) {
+		t.Fatal("pinned block was evicted")
+	}
+	if c.Size() > 200 {
+		t.Errorf("size is %d, above limit", c.Size())
+	}
+
+	// pinned blocks survive a restart
+	c, err := New(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.PinnedSize() != 100 || !c.Has("blob", 0) {
+		t.Fatal("pinned block lost after reopening")
+	}
+
+	// once unpinned, the block is the first to go
+	c.Unpin("blob", 0)
+	if c.PinnedSize() != 0 || c.Size() != 200 {
+		t.Errorf("unexpected sizes after unpin (size %d, pinned %d)", c.Size(), c.PinnedSize())
+	}
+	if c.Has("blob", 0) {
+		t.Error("unpinned block not evicted first")
+	}
+}
+
+func TestRemovePinned(t *testing.T) {
+	c, dir := tempCache(t, 200)
+	defer os.RemoveAll(dir)
+
+	c.Put("blob", 0, block('a', 100))
+	c.Pin("blob", 0)
+	c.Remove("blob", 0)
+	if c.Has("blob", 0) || c.PinnedSize() != 0 {
+		t.Error("pinned block not removed")
+	}
+}
@@ -0,0 +1,120 @@
+// Package bwlimit implements token bucket bandwidth limiters whose rate can
+// be changed at any time.
+package bwlimit
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter limits throughput to a number of bytes per second. A rate of 0
+// means unlimited.
+type Limiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	lk     sync.Mutex
+}
+
+func New(rate int64) *Limiter {
+	return &Limiter{rate: rate, last: time.Now()}
+}
+
+// SetRate changes the rate of the limiter, effective immediately
+func (l *Limiter) SetRate(rate int64) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if rate == l.rate {
+		return
+	}
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+func (l *Limiter) Rate() int64 {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.rate
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// transferring them
+func (l *Limiter) reserve(n int) time.Duration {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	l.last = now
+	if l.tokens > float64(l.rate) {
+		// allow bursts of up to one second
+		l.tokens = float64(l.rate)
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes can be transferred under all given limiters.
+// Nil limiters are ignored.
+func Wait(ctx context.Context, n int, limiters ...*Limiter) error {
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// maximum size of a single read, so that waits stay short and smooth
+const chunkLen = 32 * 1024
+
+// NewReader returns a reader reading from r no faster than what limiters
+// allow
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkLen {
+		p = p[:chunkLen]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := Wait(r.ctx, n, r.limiters...); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/AtOnline/drive-webdav/cfgpath"
+)
+
+// Config holds user settings, loaded from config.json in the config
+// directory. Missing values keep their defaults.
+type Config struct {
+	// WriteBack makes PUT requests return as soon as data has been spooled
+	// to disk, the actual upload happening in the background
+	WriteBack bool `json:"write_back"`
+
+	// ReadAheadBlock is the size of ranged requests when downloading, and
+	// ReadAhead the number of blocks fetched in advance on sequential reads
+	ReadAheadBlock int64 `json:"read_ahead_block"`
+	ReadAhead      int   `json:"read_ahead"`
+
+	// StallTimeout is the number of seconds a download can go without
+	// receiving data before being restarted, up to StallRetries times
+	StallTimeout int `json:"stall_timeout"`
+	StallRetries int `json:"stall_retries"`
+
+	// CacheSize is the maximum size in bytes of downloaded data kept on
+	// disk, 0 disables the cache
+	CacheSize int64 `json:"cache_size"`
+
+	// PinInterval is the number of seconds between checks of pinned paths
+	// for remote changes
+	PinInterval int `json:"pin_interval"`
+
+	// DriveTTL, FolderTTL and FileTTL are the number of seconds metadata of
+	// the drives list, folders and files is kept before being reloaded, 0
+	// meaning forever
+	DriveTTL  int `json:"drive_ttl"`
+	FolderTTL int `json:"folder_ttl"`
+	FileTTL   int `json:"file_ttl"`
+
+	// MetaCache saves known folder contents to disk, so they are available
+	// immediately after a restart
+	MetaCache bool `json:"metadata_cache"`
+
+	// MaxNodes is the number of nodes kept in memory, above which contents
+	// of least recently used folders are dropped. 0 means no limit.
+	MaxNodes int `json:"max_nodes"`
+
+	// WatchInterval is the number of seconds between checks of loaded
+	// folders for remote changes, 0 disables checks
+	WatchInterval int `json:"watch_interval"`
+
+	// WatchRecent is the number of seconds after their last use during which
+	// folders are checked, and WatchMax the maximum number of folders checked
+	// each time, most recently used first. 0 means no limit.
+	WatchRecent int `json:"watch_recent"`
+	WatchMax    int `json:"watch_max"`
+
+	// CaseInsensitive lists User-Agent substrings of clients for which
+	// lookups of paths ignore case when there is no exact match, as Windows
+	// clients expect
+	CaseInsensitive []string `json:"case_insensitive"`
+
+	Warm WarmConfig `json:"warm"`
+
+	Redirect RedirectConfig `json:"redirect"`
+
+	Bandwidth BandwidthConfig `json:"bandwidth"`
+}
+
+// BandwidthConfig sets transfer limits in bytes per second, 0 meaning
+// unlimited. The first schedule rule matching the current time replaces the
+// global limits. Client limits apply on top of global ones.
+type BandwidthConfig struct {
+	Upload   int64             `json:"upload"`
+	Download int64             `json:"download"`
+	Schedule []BandwidthRule   `json:"schedule"`
+	Clients  []BandwidthClient `json:"clients"`
+}
+
+type BandwidthRule struct {
+	Days     []string `json:"days"` // mon, tue, ...; empty for every day
+	From     string   `json:"from"` // HH:MM, local time
+	To       string   `json:"to"`
+	Upload   int64    `json:"upload"`
+	Download int64    `json:"download"`
+}
+
+type BandwidthClient struct {
+	Match    string `json:"match"` // User-Agent substring
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+}
+
+// WarmConfig controls the cache warmer, which loads folders in the
+// background so they are known before being browsed
+type WarmConfig struct {
+	Paths       []string `json:"paths"`       // paths to walk, such as /Drive/Folder
+	Depth       int      `json:"depth"`       // levels of subfolders to load below each path
+	Concurrency int      `json:"concurrency"` // folders loaded at once
+	Rate        float64  `json:"rate"`        // folder loads per second, 0 for no limit
+	Interval    int      `json:"interval"`    // seconds between walks, 0 to walk once at startup
+}
+
+// RedirectConfig controls redirect mode, where GET and HEAD requests on files
+// are answered with a redirect to the storage url instead of proxying data.
+// Empty lists match everything.
+type RedirectConfig struct {
+	Enabled    bool     `json:"enabled"`
+	UserAgents []string `json:"user_agents"` // User-Agent substrings to redirect
+	Paths      []string `json:"paths"`       // path prefixes to redirect
+
+	// User-Agent substrings of clients known to mishandle redirects, which
+	// are always proxied
+	Exclude []string `json:"exclude"`
+}
+
+// maxWarmRate is the highest accepted warm.rate, in folder loads per second
+const maxWarmRate = 100
+
+var config = &Config{
+	ReadAheadBlock: 1024 * 1024,
+	ReadAhead:      4,
+	StallTimeout:   30,
+	StallRetries:   5,
+	CacheSize:      1024 * 1024 * 1024,
+	PinInterval:    900,
+	DriveTTL:       600,
+	FolderTTL:      60,
+	FileTTL:        300,
+	MetaCache:      true,
+	WatchInterval:  60,
+	WatchRecent:    3600,
+	WatchMax:       100,
+	MaxNodes:       500000,
+	Warm: WarmConfig{
+		Depth:       2,
+		Concurrency: 2,
+		Rate:        5,
+		Interval:    3600,
+	},
+	Redirect: RedirectConfig{
+		Exclude: []string{
+			"Microsoft-WebDAV-MiniRedir", // Windows Explorer
+			"WebDAVFS",                   // macOS Finder
+			"davfs2",
+			"gvfs",
+			"Microsoft Office",
+		},
+	},
+}
+
+func loadConfig() {
+	p := filepath.Join(cfgpath.GetConfigDir(), "config.json")
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[config] failed to read %s: %s", p, err)
+		}
+		return
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		log.Printf("[config] failed to parse %s: %s", p, err)
+		return
+	}
+	log.Printf("[config] loaded %s", p)
+
+	if config.ReadAheadBlock < 64*1024 {
+		config.ReadAheadBlock = 64 * 1024
+	}
+	if config.ReadAhead < 0 {
+		config.ReadAhead = 0
+	}
+	if config.PinInterval < 60 {
+		config.PinInterval = 60
+	}
+	if config.Warm.Concurrency < 1 {
+		config.Warm.Concurrency = 1
+	}
+	if config.Warm.Rate < 0 {
+		config.Warm.Rate = 0
+	}
+	if config.Warm.Rate > maxWarmRate {
+		config.Warm.Rate = maxWarmRate
+	}
+	if config.Warm.Interval > 0 && config.Warm.Interval < 60 {
+		config.Warm.Interval = 60
+	}
+}
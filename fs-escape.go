@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Drive names may contain characters which are not valid in file names on
+// some platforms, or in a path segment at all. Such characters are exposed
+// as lookalike unicode characters. Lookalikes (and the quote character)
+// present in the original name are prefixed with a quote character, so the
+// mapping is reversible.
+
+const escapeQuote = '‛'
+
+var escapeMap = map[rune]rune{
+	'/':  '／',
+	'\\': '＼',
+	':':  '：',
+	'*':  '＊',
+	'?':  '？',
+	'"':  '＂',
+	'<':  '＜',
+	'>':  '＞',
+	'|':  '｜',
+}
+
+// replacements for trailing dots and spaces
+const (
+	escapeDot   = '．'
+	escapeSpace = '␠'
+)
+
+// lookalikes maps replacement characters back to the original
+var lookalikes = func() map[rune]rune {
+	res := map[rune]rune{escapeDot: '.', escapeSpace: ' '}
+	for k, v := range escapeMap {
+		res[v] = k
+	}
+	for c := rune(0); c < 0x20; c++ {
+		res[0x2400+c] = c // control pictures
+	}
+	return res
+}()
+
+// encodeName converts a Drive name to a name usable as a path segment
+func encodeName(name string) string {
+	// trailing dots and spaces are dropped by Windows
+	trail := len(name) - len(strings.TrimRight(name, ". "))
+
+	var b strings.Builder
+	for i, c := range name {
+		if _, ok := lookalikes[c]; ok || c == escapeQuote {
+			b.WriteRune(escapeQuote)
+			b.WriteRune(c)
+			continue
+		}
+		switch {
+		case c < 0x20:
+			b.WriteRune(0x2400 + c)
+		case i >= len(name)-trail && c == '.':
+			b.WriteRune(escapeDot)
+		case i >= len(name)-trail && c == ' ':
+			b.WriteRune(escapeSpace)
+		default:
+			if r, ok := escapeMap[c]; ok {
+				b.WriteRune(r)
+			} else {
+				b.WriteRune(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// decodeName converts a path segment back to a Drive name
+func decodeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		c, l := utf8.DecodeRuneInString(name[i:])
+		i += l
+		if c == escapeQuote && i < len(name) {
+			// literal character
+			c, l = utf8.DecodeRuneInString(name[i:])
+			i += l
+			b.WriteRune(c)
+			continue
+		}
+		if r, ok := lookalikes[c]; ok {
+			c = r
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeName(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"report.pdf", "report.pdf"},
+		{"a/b", "a／b"},
+		{`a\b`, "a＼b"},
+		{"a:b", "a：b"},
+		{"a*b", "a＊b"},
+		{"a?b", "a？b"},
+		{`a"b`, "a＂b"},
+		{"a<b", "a＜b"},
+		{"a>b", "a＞b"},
+		{"a|b", "a｜b"},
+		{"a\tb", "a␉b"},
+		{"a\x00b", "a␀b"},
+		{"name. ", "name．␠"},
+		{"..", "．．"},
+		{"a.b c", "a.b c"},
+
+		// lookalikes and quotes in the original name are quoted
+		{"a／b", "a‛／b"},
+		{"a：b", "a‛：b"},
+		{"name．", "name‛．"},
+		{"a␠b", "a‛␠b"},
+		{"a␉b", "a‛␉b"},
+		{"it‛s", "it‛‛s"},
+		{"a/／b", "a／‛／b"},
+	}
+
+	for _, tt := range tests {
+		if got := encodeName(tt.name); got != tt.want {
+			t.Errorf("encodeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := decodeName(tt.want); got != tt.name {
+			t.Errorf("decodeName(%q) = %q, want %q", tt.want, got, tt.name)
+		}
+	}
+}
+
+func TestEncodeNameRoundTrip(t *testing.T) {
+	var all []string
+	for c := range lookalikes {
+		all = append(all, string(c))
+	}
+	for c := range escapeMap {
+		all = append(all, string(c))
+	}
+	all = append(all, string(escapeQuote), ".", " ", "\x00", "\n", "x")
+
+	// every pair of special characters, in the middle and at the end
+	for _, a := range all {
+		for _, b := range all {
+			for _, name := range []string{a + b, "x" + a + b + "x", a + "‛" + b} {
+				enc := encodeName(name)
+				if strings.ContainsAny(enc, `/\:*?"<>|`) || strings.HasSuffix(enc, ".") || strings.HasSuffix(enc, " ") {
+					t.Errorf("encodeName(%q) = %q is not a valid path segment", name, enc)
+				}
+				if dec := decodeName(enc); dec != name {
+					t.Errorf("decodeName(encodeName(%q)) = %q", name, dec)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/cfgpath"
+	bolt "go.etcd.io/bbolt"
+)
+
+// metaStore keeps the contents of loaded folders in a database in the cache
+// directory, so that after a restart a folder can be served at once from its
+// last known state while it is reloaded in the background. Folders are
+// stored in one bucket per drive, keyed by item id, and only folders which
+// changed are written. The list of drives is stored in its own bucket, keyed
+// by account. Download urls are not kept, a new one is obtained when needed.
+// Blob hashes are kept while a stored folder refers to the blob.
+type metaStore struct {
+	fs      *DriveFS
+	db      *bolt.DB
+	account []byte // key of the list of drives
+	done    chan struct{}
+
+	lk      sync.Mutex
+	dirty   map[*fsNode]bool  // folders to write
+	removed map[*fsNode]bool  // folders to delete, with their subfolders
+	hashes  map[string]string // blob hashes to write
+}
+
+const metaVersion = "3"
+
+var (
+	metaInfoBucket   = []byte("meta")
+	metaHashesBucket = []byte("hashes")
+	metaDrivesBucket = []byte("drives")
+)
+
+// metaRecord is a child of a stored folder
+type metaRecord struct {
+	Id       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	Type     string                 `json:"type"`
+	Blob     string                 `json:"blob,omitempty"`
+	Mime     string                 `json:"mime,omitempty"`
+	Size     int64                  `json:"size"`
+	Modified time.Time              `json:"modified"`
+	Info     map[string]interface{} `json:"info,omitempty"`
+	Download bool                   `json:"download,omitempty"` // file had a download url
+	Drive    string                 `json:"drive,omitempty"`    // drive of the item, if not the folder's
+}
+
+// newMetaStore opens the store in file, or returns nil if it cannot be used
+func newMetaStore(fs *DriveFS, file string) *metaStore {
+	// snapshot written by previous versions
+	os.Remove(filepath.Join(filepath.Dir(file), "meta.json"))
+
+	if err := cfgpath.EnsureDir(filepath.Dir(file)); err != nil {
+		log.Printf("[meta] failed to open store: %s", err)
+		return nil
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Printf("[meta] failed to open store: %s", err)
+		return nil
+	}
+	m := &metaStore{
+		fs:      fs,
+		db:      db,
+		account: []byte("account:" + fs.c.ClientId()),
+		done:    make(chan struct{}),
+		dirty:   make(map[*fsNode]bool),
+		removed: make(map[*fsNode]bool),
+		hashes:  make(map[string]string),
+	}
+	if err := m.init(); err != nil {
+		log.Printf("[meta] failed to open store: %s", err)
+		db.Close()
+		return nil
+	}
+	go m.run()
+	return m
+}
+
+// init clears the store if it was written by another version, and loads
+// known blob hashes
+func (m *metaStore) init() error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(metaInfoBucket); b != nil && string(b.Get([]byte("version"))) == metaVersion {
+			return nil
+		}
+		var names [][]byte
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			names = append(names, name)
+			return nil
+		})
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket(metaInfoBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(metaHashesBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(metaDrivesBucket); err != nil {
+			return err
+		}
+		return b.Put([]byte("version"), []byte(metaVersion))
+	})
+	if err != nil {
+		return err
+	}
+
+	m.fs.hashesL.Lock()
+	defer m.fs.hashesL.Unlock()
+	return m.db.Update(func(tx *bolt.Tx) error {
+		blobs := m.blobs(tx)
+		b := tx.Bucket(metaHashesBucket)
+		var unused [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if !blobs[string(k)] {
+				unused = append(unused, k)
+				return nil
+			}
+			m.fs.hashes[string(k)] = string(v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range unused {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// blobs returns the blobs of files in stored folders
+func (m *metaStore) blobs(tx *bolt.Tx) map[string]bool {
+	res := make(map[string]bool)
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if bytes.Equal(name, metaInfoBucket) || bytes.Equal(name, metaHashesBucket) {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var recs []*metaRecord
+			if json.Unmarshal(v, &recs) != nil {
+				return nil
+			}
+			for _, rec := range recs {
+				if rec.Blob != "" {
+					res[rec.Blob] = true
+				}
+			}
+			return nil
+		})
+	})
+	return res
+}
+
+// location returns the bucket and key of folder n in the store
+func (m *metaStore) location(n *fsNode) ([]byte, []byte) {
+	if n.isRoot {
+		return metaDrivesBucket, m.account
+	}
+	return []byte(n.driveId), []byte(n.Id)
+}
+
+// touch records that the contents of folder n changed and need to be saved
+func (m *metaStore) touch(n *fsNode) {
+	if m == nil || n == nil {
+		return
+	}
+	m.lk.Lock()
+	m.dirty[n] = true
+	m.lk.Unlock()
+}
+
+// forget records that folder n no longer exists
+func (m *metaStore) forget(n *fsNode) {
+	if m == nil || !n.IsDir() {
+		return
+	}
+	m.lk.Lock()
+	delete(m.dirty, n)
+	m.removed[n] = true
+	m.lk.Unlock()
+}
+
+// setHash records the sha256 of a blob
+func (m *metaStore) setHash(blob, hash string) {
+	if m == nil {
+		return
+	}
+	m.lk.Lock()
+	m.hashes[blob] = hash
+	m.lk.Unlock()
+}
+
+func (m *metaStore) run() {
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.save()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// close saves pending changes and closes the store
+func (m *metaStore) close() {
+	if m == nil {
+		return
+	}
+	close(m.done)
+	m.save()
+	m.db.Close()
+}
+
+// dropDrives removes the stored list of drives, which may belong to another
+// user after logging in again
+func (m *metaStore) dropDrives() {
+	if m == nil {
+		return
+	}
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaDrivesBucket).Delete(m.account)
+	})
+	if err != nil {
+		log.Printf("[meta] failed to drop list of drives: %s", err)
+	}
+}
+
+// save writes changes recorded since the last save
+func (m *metaStore) save() {
+	m.lk.Lock()
+	dirty, removed, hashes := m.dirty, m.removed, m.hashes
+	m.dirty, m.removed, m.hashes = make(map[*fsNode]bool), make(map[*fsNode]bool), make(map[string]string)
+	m.lk.Unlock()
+
+	// encode before starting the transaction, not to hold the database while
+	// taking node locks
+	data := make(map[*fsNode][]byte, len(dirty))
+	for n := range dirty {
+		if v := m.encode(n); v != nil {
+			data[n] = v
+		}
+	}
+	if len(data) == 0 && len(removed) == 0 && len(hashes) == 0 {
+		return
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		for n := range removed {
+			if err := m.delete(tx, n.driveId, n.Id); err != nil {
+				return err
+			}
+		}
+		for n, v := range data {
+			bucket, key := m.location(n)
+			b, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, v); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket(metaHashesBucket)
+		for k, v := range hashes {
+			if err := b.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[meta] failed to save: %s", err)
+	}
+}
+
+// encode returns the stored form of the contents of folder n, or nil if they
+// are not loaded
+func (m *metaStore) encode(n *fsNode) []byte {
+	if !n.loaded() {
+		// dropped from memory, keep what is stored
+		return nil
+	}
+	list := n.childList()
+	recs := make([]*metaRecord, 0, len(list))
+	for _, c := range list {
+		if c.Id == "" {
+			// placeholder of a queued upload, recreated by the queue
+			continue
+		}
+		c.lk.RLock()
+		rec := &metaRecord{
+			Id:       c.Id,
+			Name:     c.name,
+			Type:     c.Type,
+			Blob:     c.Blob,
+			Mime:     c.mime,
+			Size:     c.size,
+			Modified: c.LastModified,
+			Info:     c.info,
+		}
+		c.lk.RUnlock()
+		rec.Download = c.downloadable()
+		if c.driveId != n.driveId {
+			// drives, listed by the root
+			rec.Drive = c.driveId
+		}
+		recs = append(recs, rec)
+	}
+	data, err := json.Marshal(recs)
+	if err != nil {
+		log.Printf("[meta] failed to encode %s: %s", n.path(), err)
+		return nil
+	}
+	return data
+}
+
+// delete removes folder id of drive from the store, with its subfolders
+func (m *metaStore) delete(tx *bolt.Tx, drive, id string) error {
+	b := tx.Bucket([]byte(drive))
+	if b == nil {
+		return nil
+	}
+	var recs []*metaRecord
+	if data := b.Get([]byte(id)); data != nil {
+		json.Unmarshal(data, &recs)
+	}
+	for _, rec := range recs {
+		if rec.Type == "folder" {
+			if err := m.delete(tx, drive, rec.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return b.Delete([]byte(id))
+}
+
+// restore fills folder n with its stored contents, and returns false if
+// there are none. Subfolders are restored when loaded in turn.
+func (m *metaStore) restore(n *fsNode) bool {
+	if m == nil || n.Id == "" || (n.driveId == "" && !n.isRoot) {
+		return false
+	}
+	bucket, key := m.location(n)
+	var recs []*metaRecord
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		if data := b.Get(key); data != nil {
+			return json.Unmarshal(data, &recs)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[meta] failed to read %s: %s", n.path(), err)
+		return false
+	}
+	if recs == nil {
+		return false
+	}
+
+	now := time.Now()
+	children := make(map[string]*fsNode, len(recs))
+	for _, rec := range recs {
+		c := &fsNode{
+			fs:           n.fs,
+			Id:           rec.Id,
+			Type:         rec.Type,
+			driveId:      rec.Drive,
+			name:         rec.Name,
+			parent:       n,
+			Blob:         rec.Blob,
+			mime:         rec.Mime,
+			size:         rec.Size,
+			LastModified: rec.Modified,
+			info:         rec.Info,
+			urlLater:     rec.Download,
+		}
+		if c.driveId == "" {
+			c.driveId = n.driveId
+		}
+		if c.Type == "file" {
+			c.refresh = now
+		}
+		children[c.name] = c
+	}
+	n.setChildren(children, false)
+	n.setRefresh(now)
+	if n.fs.queue != nil {
+		n.fs.queue.attach(n)
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetaRestore(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "meta-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api := newFakeAPI()
+	fs := testFS(api)
+	m := newMetaStore(fs, filepath.Join(dir, "meta.db"))
+	if m == nil {
+		t.Fatal("failed to open store")
+	}
+	defer m.db.Close()
+	fs.meta = m
+	if _, err := fs.root.get("/Test/a/sub/f0.txt"); err != nil {
+		t.Fatal(err)
+	}
+	m.save()
+
+	// change made while not running
+	api.lk.Lock()
+	api.items["a-f0"].name = "changed.txt"
+	api.lk.Unlock()
+
+	// restart: stored contents are served, then updated
+	fs = testFS(api)
+	fs.meta, m.fs = m, fs
+	ch, done := fs.changes.subscribe()
+	defer done()
+	f, err := fs.root.get("/Test/a/f0.txt")
+	if err != nil {
+		t.Fatalf("stored contents not restored: %s", err)
+	}
+	if !f.downloadable() || f.downloadUrl() != "" {
+		t.Error("restored file should be downloadable, without url")
+	}
+	if _, err := fs.root.get("/Test/a/sub/f1.txt"); err != nil {
+		t.Fatalf("stored subfolder not restored: %s", err)
+	}
+
+	select {
+	case ev := <-ch:
+		if ev.Path != "/Test/a/changed.txt" && ev.Path != "/Test/a/f0.txt" {
+			t.Errorf("unexpected change %s %s", ev.Type, ev.Path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("restored folder not reloaded")
+	}
+
+	// only changed folders are written
+	m.lk.Lock()
+	dirty := len(m.dirty)
+	m.lk.Unlock()
+	if dirty != 1 {
+		t.Errorf("expected 1 folder to save, got %d", dirty)
+	}
+}
+
+// TestMetaOffline checks that stored contents, the list of drives included,
+// can be browsed when starting without network, and that hashes of blobs no
+// longer stored are dropped
+func TestMetaOffline(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "meta-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "meta.db")
+
+	api := newFakeAPI()
+	fs := testFS(api)
+	m := newMetaStore(fs, file)
+	if m == nil {
+		t.Fatal("failed to open store")
+	}
+	fs.meta = m
+	if _, err := fs.root.get("/Test/a/sub/f0.txt"); err != nil {
+		t.Fatal(err)
+	}
+	m.setHash("blob-a-sub-f0", "used")
+	m.setHash("blob-gone", "unused")
+	m.close()
+
+	// restart without network
+	fs = testFS(api)
+	fs.c.Client.Transport = unreachable{}
+	m = newMetaStore(fs, file)
+	if m == nil {
+		t.Fatal("failed to open store")
+	}
+	defer m.close()
+	fs.meta = m
+	if _, err := fs.root.get("/Test/a/sub/f1.txt"); err != nil {
+		t.Errorf("stored contents not available offline: %s", err)
+	}
+	if fs.blobHash("blob-a-sub-f0") != "used" || fs.blobHash("blob-gone") != "" {
+		t.Errorf("hashes not pruned as expected: %v", fs.hashes)
+	}
+}
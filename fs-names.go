@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/AtOnline/drive-webdav/cfgpath"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Drive allows several items with the same name in a folder, which need
+// distinct names to be reachable. Duplicates get a " (N)" suffix before the
+// extension. Which item gets which suffix is remembered by item id, so a
+// path keeps pointing at the same item across reloads and restarts. When
+// nothing is known yet, the item with the lowest id gets the plain name.
+//
+// Suffixes are kept per folder, for folders which have duplicates, and
+// saved in a file per drive in the background.
+type nameMap struct {
+	dir    string // where files are saved, none if empty
+	drives map[string]*driveNames
+	lk     sync.Mutex
+}
+
+// driveNames holds suffixes of items of a drive, by folder then item id, 1
+// being the plain name
+type driveNames struct {
+	folders map[string]map[string]int
+	dirty   bool
+}
+
+// nameItem is an item of a folder listing to be named
+type nameItem struct {
+	id      string
+	name    string // name of the item on Drive
+	folder  bool
+	current string // name currently used in the tree, if any
+}
+
+func newNameMap(dir string) *nameMap {
+	m := &nameMap{
+		dir:    dir,
+		drives: make(map[string]*driveNames),
+	}
+	if dir != "" {
+		// file shared by all accounts, written by previous versions
+		os.Remove(filepath.Join(filepath.Dir(dir), "names.json"))
+		go m.run()
+	}
+	return m
+}
+
+// drive returns the suffixes known for drive, loading them if needed. Must
+// be called with lock held.
+func (m *nameMap) drive(drive string) *driveNames {
+	if d, ok := m.drives[drive]; ok {
+		return d
+	}
+	d := &driveNames{folders: make(map[string]map[string]int)}
+	m.drives[drive] = d
+	if f := m.file(drive); f != "" {
+		data, err := ioutil.ReadFile(f)
+		if err == nil {
+			err = json.Unmarshal(data, &d.folders)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("[names] failed to load %s: %s", f, err)
+		}
+	}
+	return d
+}
+
+// file returns where suffixes of drive are saved, or an empty string. The
+// drives list itself is not saved, as it is not specific to a drive.
+func (m *nameMap) file(drive string) string {
+	if m.dir == "" || drive == "" {
+		return ""
+	}
+	return filepath.Join(m.dir, drive+".json")
+}
+
+func (m *nameMap) run() {
+	for range time.Tick(30 * time.Second) {
+		m.save()
+	}
+}
+
+// save writes suffixes of drives which changed since the last save
+func (m *nameMap) save() {
+	m.lk.Lock()
+	data := make(map[string][]byte)
+	for drive, d := range m.drives {
+		if !d.dirty || m.file(drive) == "" {
+			continue
+		}
+		d.dirty = false
+		v, err := json.Marshal(d.folders)
+		if err != nil {
+			log.Printf("[names] failed to save: %s", err)
+			continue
+		}
+		data[m.file(drive)] = v
+	}
+	m.lk.Unlock()
+	if len(data) == 0 {
+		return
+	}
+
+	if err := cfgpath.EnsureDir(m.dir); err != nil {
+		log.Printf("[names] failed to save: %s", err)
+		return
+	}
+	for f, v := range data {
+		err := ioutil.WriteFile(f+".new", v, 0600)
+		if err == nil {
+			err = os.Rename(f+".new", f)
+		}
+		if err != nil {
+			log.Printf("[names] failed to save: %s", err)
+		}
+	}
+}
+
+// dupName returns the name of the k-th item called name, k starting at 1
+func dupName(name string, k int, folder bool) string {
+	if k <= 1 {
+		return name
+	}
+	ext := path.Ext(name)
+	if folder || ext == name || ext == "" {
+		return fmt.Sprintf("%s (%d)", name, k)
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), k, ext)
+}
+
+// suffixOf returns k if current is dupName(name, k, folder), or 0
+func suffixOf(name, current string, folder bool) int {
+	if current == name {
+		return 1
+	}
+	var k int
+	ext := path.Ext(name)
+	stem := name
+	if !folder && ext != name {
+		stem = strings.TrimSuffix(name, ext)
+	} else {
+		ext = ""
+	}
+	if !strings.HasPrefix(current, stem+" (") || !strings.HasSuffix(current, ")"+ext) {
+		return 0
+	}
+	if _, err := fmt.Sscanf(current[len(stem)+2:len(current)-len(ext)-1], "%d", &k); err != nil || k < 2 {
+		return 0
+	}
+	if dupName(name, k, folder) != current {
+		return 0
+	}
+	return k
+}
+
+// assign returns names for the items of a listing of folder in drive, by
+// item id. Suffixes of items no longer in the folder are forgotten.
+func (m *nameMap) assign(drive, folder string, items []nameItem) map[string]string {
+	res := make(map[string]string, len(items))
+	groups := make(map[string][]nameItem)
+	taken := make(map[string]bool) // actual names, not available as suffixed names
+	for _, it := range items {
+		groups[it.name] = append(groups[it.name], it)
+		taken[it.name] = true
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	d := m.drive(drive)
+	known := d.folders[folder]
+	index := make(map[string]int)
+
+	bases := make([]string, 0, len(groups))
+	for name, list := range groups {
+		if len(list) == 1 {
+			res[list[0].id] = name
+			continue
+		}
+		bases = append(bases, name)
+	}
+	sort.Strings(bases)
+
+	used := make(map[string]bool)
+	for _, name := range bases {
+		list := groups[name]
+		sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+		free := func(k int) bool {
+			n := dupName(name, k, list[0].folder)
+			return !used[n] && (k == 1 || !taken[n])
+		}
+		give := func(it nameItem, k int) {
+			n := dupName(name, k, it.folder)
+			used[n] = true
+			res[it.id] = n
+			index[it.id] = k
+		}
+
+		// keep known suffixes, then current names, then fill in by id
+		var rest []nameItem
+		for _, it := range list {
+			if k, ok := known[it.id]; ok && free(k) {
+				give(it, k)
+			} else {
+				rest = append(rest, it)
+			}
+		}
+		var next []nameItem
+		for _, it := range rest {
+			if k := suffixOf(name, it.current, it.folder); k > 0 && free(k) {
+				give(it, k)
+			} else {
+				next = append(next, it)
+			}
+		}
+		k := 1
+		for _, it := range next {
+			for !free(k) {
+				k++
+			}
+			give(it, k)
+		}
+	}
+
+	if !sameIndex(known, index) {
+		if len(index) > 0 {
+			d.folders[folder] = index
+		} else {
+			delete(d.folders, folder)
+		}
+		d.dirty = true
+	}
+	return res
+}
+
+func sameIndex(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, k := range a {
+		if v, ok := b[id]; !ok || v != k {
+			return false
+		}
+	}
+	return true
+}
+
+// record remembers the suffix given to an item of folder in drive added
+// outside of a listing
+func (m *nameMap) record(drive, folder, id string, k int) {
+	if id == "" {
+		return
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	d := m.drive(drive)
+	index := d.folders[folder]
+	if index == nil {
+		index = make(map[string]int)
+		d.folders[folder] = index
+	} else if index[id] == k {
+		return
+	}
+	index[id] = k
+	d.dirty = true
+}
+
+// matchKey returns the form of name used to match names sent by clients
+// with names of the tree, its canonical decomposition (NFD), as macOS
+// clients send NFD while others send what they got. If fold is set, case is
+// folded too.
+func matchKey(name string, fold bool) string {
+	simple := true
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			simple = false
+			break
+		}
+	}
+	if simple && !fold {
+		return name
+	}
+
+	name = norm.NFD.String(name)
+	if !fold {
+		return name
+	}
+	res := []rune(name)
+	for i, r := range res {
+		res[i] = foldRune(r)
+	}
+	return string(res)
+}
+
+// foldCase returns true if paths requested by r are matched regardless of
+// case, see config.CaseInsensitive
+func foldCase(r *http.Request) bool {
+	if r == nil || len(config.CaseInsensitive) == 0 {
+		return false
+	}
+	ua := r.Header.Get("User-Agent")
+	return matchAny(config.CaseInsensitive, func(s string) bool { return strings.Contains(ua, s) })
+}
+
+// foldRune returns the smallest character r is equivalent to under simple
+// case folding
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
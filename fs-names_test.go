@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAssign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "names-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := newNameMap(dir)
+	items := []nameItem{{id: "b", name: "report.pdf"}, {id: "a", name: "report.pdf"}, {id: "c", name: "other.pdf"}}
+	res := m.assign("drv", "folder", items)
+	if res["a"] != "report.pdf" || res["b"] != "report (2).pdf" || res["c"] != "other.pdf" {
+		t.Fatalf("unexpected names %v", res)
+	}
+
+	// an item named after a suffixed name takes it, others keep theirs
+	items = append(items, nameItem{id: "0", name: "report (2).pdf"})
+	res = m.assign("drv", "folder", items)
+	if res["a"] != "report.pdf" || res["b"] != "report (3).pdf" || res["0"] != "report (2).pdf" {
+		t.Fatalf("unexpected names %v", res)
+	}
+
+	// kept across restarts
+	m.save()
+	m = newNameMap(dir)
+	res = m.assign("drv", "folder", []nameItem{{id: "b", name: "report.pdf"}, {id: "a", name: "report.pdf"}, {id: "0", name: "report (2).pdf"}})
+	if res["b"] != "report (3).pdf" {
+		t.Fatalf("suffix not kept across restart: %v", res)
+	}
+	if m.drive("other").folders["folder"] != nil {
+		t.Fatal("suffixes shared between drives")
+	}
+
+	// forgotten when the duplicate is gone
+	m.assign("drv", "folder", []nameItem{{id: "a", name: "report.pdf"}})
+	if _, ok := m.drive("drv").folders["folder"]; ok {
+		t.Fatal("suffixes of removed items kept")
+	}
+}
+
+func TestMatchKey(t *testing.T) {
+	nfc, nfd := "café.txt", "café.txt"
+	if matchKey(nfc, false) != matchKey(nfd, false) {
+		t.Error("NFC and NFD forms do not match")
+	}
+	if matchKey("Report.PDF", false) == matchKey("report.pdf", false) {
+		t.Error("case folded without fold")
+	}
+	if matchKey("CAFÉ.TXT", true) != matchKey(nfd, true) {
+		t.Error("case not folded with fold")
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	defer func(v []string) { config.CaseInsensitive = v }(config.CaseInsensitive)
+	config.CaseInsensitive = []string{"Microsoft-WebDAV-MiniRedir"}
+
+	r := httptest.NewRequest("PROPFIND", "/", nil)
+	r.Header.Set("User-Agent", "Microsoft-WebDAV-MiniRedir/10.0.19045")
+	if !foldCase(r) {
+		t.Error("listed client not case insensitive")
+	}
+	r.Header.Set("User-Agent", "WebDAVFS/3.0.0 (03008000) Darwin/22.1.0")
+	if foldCase(r) {
+		t.Error("other client case insensitive")
+	}
+	if foldCase(nil) {
+		t.Error("internal lookup case insensitive")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Loaded metadata expires after a time depending on the kind of node, and
+// is reloaded on next access. A subtree can also be marked as stale
+// explicitly through /_refresh or a PROPFIND with Cache-Control: no-cache.
+
+// ttl returns how long loaded data of n stays valid
+func (n *fsNode) ttl() time.Duration {
+	var s int
+	switch {
+	case n.isRoot:
+		s = config.DriveTTL
+	case n.Type == "folder":
+		s = config.FolderTTL
+	default:
+		s = config.FileTTL
+	}
+	if s <= 0 {
+		// never expires
+		return math.MaxInt64
+	}
+	return time.Duration(s) * time.Second
+}
+
+// revalidate loads n, or reloads it if loaded data has expired
+func (n *fsNode) revalidate() {
+	n.load()
+	if time.Since(n.lastRefresh()) < n.ttl() {
+		// do not wait for a reload running in the background
+		return
+	}
+	if n.fs.isOffline() && (n.Type != "folder" || n.loaded()) {
+		// keep serving what we have
+		return
+	}
+
+	n.refreshL.Lock()
+	defer n.refreshL.Unlock()
+
+	if time.Since(n.lastRefresh()) < n.ttl() {
+		return
+	}
+	n.loadInternal()
+}
+
+// lastRefresh returns when n's data was loaded
+func (n *fsNode) lastRefresh() time.Time {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	return n.refresh
+}
+
+func (n *fsNode) setRefresh(t time.Time) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.refresh = t
+}
+
+// invalidate marks n and its loaded subtree as expired
+func (n *fsNode) invalidate() {
+	n.setRefresh(time.Time{})
+
+	for _, c := range n.childList() {
+		c.invalidate()
+	}
+}
+
+// refresh forces the subtree at path to be reloaded
+func (fs *DriveFS) refresh(path string) error {
+	n, err := fs.root.get(path)
+	if err != nil {
+		return err
+	}
+	n.invalidate()
+	n.revalidate()
+	return n.loadErr()
+}
+
+// noCache returns true if the client asked for fresh data
+func noCache(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Cache-Control"), "no-cache") || r.Header.Get("Pragma") == "no-cache"
+}
+
+// serveRefresh handles POST /_refresh?path=/some/path
+func (fs *DriveFS) serveRefresh(w http.ResponseWriter, r *http.Request) {
+	if !controlAllowed(w, r) {
+		return
+	}
+	p := r.FormValue("path")
+	if p == "" {
+		p = "/"
+	}
+	if err := fs.refresh(p); err != nil {
+		http.Error(w, fmt.Sprintf("failed to refresh %s: %s", p, err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "refreshed %s\n", p)
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
+	"hash"
 	"io"
-	"net/http"
 	"os"
 
+	"github.com/AtOnline/drive-webdav/bwlimit"
 	"github.com/AtOnline/drive-webdav/oauth2"
 )
 
@@ -17,111 +19,147 @@ type fsNodeFile struct {
 
 	// specific to uploads
 	parent *fsNode
+	name   string          // name of new file
+	expect int64           // expected upload size, -1 if unknown
+	req    context.Context // request writing data, if any
+	mime   string          // content type for upload, sniffed if empty
+
+	// local copy of data being written
+	stage    *os.File
+	stageId  string // spool id in write-back mode
+	stageLen int64
+	dirty    bool
+
+	// upload performed while data is written sequentially
 	upload *oauth2.Upload
+	stream bool
+	hash   hash.Hash // sha256 of data written so far, nil if not sequential
+
+	local *os.File // spooled data of a pending upload, for reads
+
+	upLimit, downLimit []*bwlimit.Limiter
 
 	pos int64
 
-	resp *http.Response
-	rpos int64 // pos in response
+	ra     *readAhead
+	verify *verifier
+
+	held []*fsNode // see fsNode.hold()
 }
 
 func (f *fsNodeFile) Close() error {
+	release(f.held)
+	f.held = nil
 	f.pos = 0
-	return f.finalizeUpload()
+	if f.local != nil {
+		f.local.Close()
+		f.local = nil
+	}
+	if f.ra != nil {
+		f.ra.Close()
+		f.ra = nil
+	}
+	err := f.finalizeUpload()
+	f.discardStage()
+	return err
 }
 
-func (f *fsNodeFile) finalizeUpload() error {
-	if f.upload != nil {
-		final, err := f.upload.Complete()
-		if err != nil {
-			return err
-		}
-		f.upload = nil
-
-		// add child if new upload
-		if f.self == nil {
-			f.parent.load()
-			f.self = f.parent.addChild(final.Data.(map[string]interface{}), "")
-		} else {
-			f.self.store(final.Data.(map[string]interface{}))
-		}
+func (f *fsNodeFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// size returns the current size of the file as seen by this handle
+func (f *fsNodeFile) size() int64 {
+	if f.stage != nil {
+		return f.stageLen
+	}
+	if f.self == nil {
+		return 0
 	}
-	return nil
+	return f.self.Size()
 }
 
 func (f *fsNodeFile) Read(d []byte) (int, error) {
-	if f.flag&os.O_RDONLY != os.O_RDONLY && f.flag&os.O_RDWR != os.O_RDWR {
+	if f.flag&os.O_WRONLY != 0 {
 		return 0, os.ErrInvalid
 	}
 
-	// perform a read, intelligently (ha ha)
-	if f.resp != nil {
-		if f.pos > f.rpos && f.pos < (f.rpos+8*1024) {
-			// we can read less than 8k of data to reach pos, that's probably faster than establishing a new http request
-			drop := f.pos - f.rpos
-			n, err := f.resp.Body.Read(make([]byte, drop))
-			if n >= 0 {
-				// with that, f.rpos should be == f.pos
-				f.rpos += int64(n)
-			}
+	if f.stage != nil {
+		// file being written, read from local copy
+		return f.readLocal(f.stage, f.stageLen, d)
+	}
+
+	if item := f.self.pendingItem(); item != nil {
+		// data not uploaded yet, read from spool
+		if f.local == nil {
+			l, err := os.Open(f.self.fs.queue.dataPath(item.Id))
 			if err != nil {
 				return 0, err
 			}
+			f.local = l
 		}
-		// can we use this response?
-		if f.rpos == f.pos {
-			// yes.
-			n, err := f.resp.Body.Read(d)
-			if n > 0 {
-				f.rpos += int64(n)
-				f.pos += int64(n)
-			}
-			return n, err
-		}
-
-		// cannot use this response
-		f.resp.Body.Close()
-		f.resp = nil
+		return f.readLocal(f.local, f.self.Size(), d)
 	}
 
 	if f.pos < 0 {
-		// jsut in case, sanity check
+		// just in case, sanity check
 		return 0, errors.New("negative seek not supported")
 	}
-	if f.pos >= f.self.size {
-		// out of file
+
+	switch f.self.contentKind() {
+	case contentUnavailable:
+		return 0, os.ErrPermission
+	case contentStub:
+		stub := f.self.stub()
+		return f.readLocal(bytes.NewReader(stub), int64(len(stub)), d)
+	case contentEmpty:
 		return 0, io.EOF
 	}
 
-	if f.self.url == "" {
-		// just do nothing since webdav doesn't like errors
-		return len(d), nil
-		//return 0, os.ErrPermission
+	blob, size := f.self.content()
+	if f.pos >= size {
+		// out of file
+		return 0, io.EOF
 	}
 
-	req, err := http.NewRequest("GET", f.self.url, nil)
-	if err != nil {
-		return 0, err
+	if f.ra == nil || f.ra.node != f.self || f.ra.blob != blob || f.ra.size != size {
+		// file changed
+		if f.ra != nil {
+			f.ra.Close()
+		}
+		f.ra = newReadAhead(f.self, f.downLimit)
+		f.verify = newVerifier(f.self)
 	}
 
-	if f.pos != 0 {
-		// need to add range to request headers
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.pos))
+	n, err := f.ra.ReadAt(d, f.pos)
+	if n > 0 {
+		if err := f.verify.update(f.pos, d[:n]); err != nil {
+			return 0, err
+		}
+		f.pos += int64(n)
+		if err == io.EOF {
+			// report EOF on next call
+			err = nil
+		}
 	}
+	return n, err
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return 0, err
+func (f *fsNodeFile) readLocal(r io.ReaderAt, size int64, d []byte) (int, error) {
+	if f.pos >= size {
+		return 0, io.EOF
+	}
+	if int64(len(d)) > size-f.pos {
+		d = d[:size-f.pos]
 	}
 
-	f.resp = res
-	f.rpos = f.pos
-
-	// perform read
-	n, err := f.resp.Body.Read(d)
+	n, err := r.ReadAt(d, f.pos)
 	if n > 0 {
-		f.rpos += int64(n)
 		f.pos += int64(n)
+		if err == io.EOF {
+			// report EOF on next call
+			err = nil
+		}
 	}
 	return n, err
 }
@@ -139,7 +177,7 @@ func (f *fsNodeFile) Seek(offset int64, whence int) (int64, error) {
 		f.pos += offset
 		return f.pos, nil
 	case io.SeekEnd:
-		f.pos = f.self.size + offset
+		f.pos = f.size() + offset
 		return f.pos, nil
 	default:
 		return f.pos, os.ErrInvalid
@@ -158,20 +196,22 @@ func (f *fsNodeFile) Stat() (os.FileInfo, error) {
 }
 
 func (f *fsNodeFile) Write(d []byte) (int, error) {
-	if f.upload == nil {
-		// TODO check if write access
-		var err error
-		f.upload, err = f.self.overwrite()
-		if err != nil {
-			return 0, err
-		}
+	if !f.writable() {
+		return 0, os.ErrPermission
 	}
-	if f.pos != f.upload.Len() {
-		// can't write here
+	if f.pos < 0 {
 		return 0, os.ErrInvalid
 	}
-	n, err := f.upload.Write(d)
+	if err := f.openStage(); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = f.stageLen
+	}
+
+	n, err := f.stage.WriteAt(d, f.pos)
 	if n > 0 {
+		f.written(f.pos, d[:n])
 		f.pos += int64(n)
 	}
 	return n, err
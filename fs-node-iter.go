@@ -10,9 +10,12 @@ type fsNodeFolderIterator struct {
 	children []os.FileInfo
 	self     *fsNode
 	pos      int
+	held     []*fsNode
 }
 
 func (f *fsNodeFolderIterator) Close() error {
+	release(f.held)
+	f.held = nil
 	return nil
 }
 
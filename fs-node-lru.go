@@ -0,0 +1,253 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// treeLRU bounds the number of nodes kept in memory. Loaded folders are
+// kept in least recently used order, and when the tree grows above the
+// limit the children of folders nobody touched recently are dropped, to be
+// loaded again on next access. Folders containing nodes with open handles,
+// pending uploads or pinned paths are kept, and so are folders loaded by a
+// running walk of the cache warmer.
+type treeLRU struct {
+	fs      *DriveFS
+	lru     *list.List // front is most recently used
+	entries map[*fsNode]*list.Element
+	kept    map[*fsNode]bool // folders loaded by the warmer, until released
+	count   int              // number of children of loaded folders
+	lk      sync.Mutex
+	wake    chan struct{}
+}
+
+type lruEntry struct {
+	node *fsNode
+	size int
+}
+
+func newTreeLRU(fs *DriveFS) *treeLRU {
+	t := &treeLRU{
+		fs:      fs,
+		lru:     list.New(),
+		entries: make(map[*fsNode]*list.Element),
+		kept:    make(map[*fsNode]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	go t.run()
+	return t
+}
+
+// loaded records that folder n now has size children
+func (t *treeLRU) loaded(n *fsNode, size int) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if e, ok := t.entries[n]; ok {
+		// reloads by the watcher do not count as use, see touch()
+		le := e.Value.(*lruEntry)
+		t.count += size - le.size
+		le.size = size
+	} else {
+		t.entries[n] = t.lru.PushFront(&lruEntry{node: n, size: size})
+		t.count += size
+	}
+	t.signal()
+}
+
+// grow records d children added to (or removed from) folder n
+func (t *treeLRU) grow(n *fsNode, d int) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if e, ok := t.entries[n]; ok {
+		e.Value.(*lruEntry).size += d
+		t.count += d
+	}
+	t.signal()
+}
+
+// touch marks folder n as recently used
+func (t *treeLRU) touch(n *fsNode) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if e, ok := t.entries[n]; ok {
+		t.lru.MoveToFront(e)
+	}
+}
+
+// keep protects loaded folder n from being dropped until release
+func (t *treeLRU) keep(n *fsNode) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if _, ok := t.entries[n]; ok {
+		t.kept[n] = true
+	}
+}
+
+// release ends the protection of folders by keep, and marks them as
+// recently used
+func (t *treeLRU) release() {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	for n := range t.kept {
+		if e, ok := t.entries[n]; ok {
+			t.lru.MoveToFront(e)
+		}
+	}
+	t.kept = make(map[*fsNode]bool)
+	t.signal()
+}
+
+// isKept returns true if n is protected by keep
+func (t *treeLRU) isKept(n *fsNode) bool {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.kept[n]
+}
+
+// signal wakes the evictor if the tree is above the limit. Must be called
+// with lock held.
+func (t *treeLRU) signal() {
+	if config.MaxNodes <= 0 || t.count <= config.MaxNodes {
+		return
+	}
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *treeLRU) run() {
+	for range t.wake {
+		if t.fs.isOffline() {
+			// nothing to reload from
+			continue
+		}
+		t.shrink()
+	}
+}
+
+// over returns by how many nodes the tree exceeds the limit
+func (t *treeLRU) over() int {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.count - config.MaxNodes
+}
+
+// shrink drops children of least recently used folders until the tree fits
+// in the limit
+func (t *treeLRU) shrink() {
+	t.lk.Lock()
+	batches := t.lru.Len()/64 + 1
+	t.lk.Unlock()
+
+	for ; batches > 0 && t.over() > 0; batches-- {
+		// candidates, least recently used first
+		var list []*fsNode
+		t.lk.Lock()
+		for e := t.lru.Back(); e != nil && len(list) < 64; e = e.Prev() {
+			list = append(list, e.Value.(*lruEntry).node)
+		}
+		t.lk.Unlock()
+
+		for _, n := range list {
+			if !t.evictable(n) {
+				// look at others next time
+				t.touch(n)
+				continue
+			}
+			t.drop(n)
+			if t.over() <= 0 {
+				return
+			}
+		}
+	}
+}
+
+// drop unloads children of folder n, once any load of n is done. Lookups
+// finding n unloaded after revalidating it load it again, see lookupLoaded.
+func (t *treeLRU) drop(n *fsNode) {
+	n.refreshL.Lock()
+	children := n.childList()
+	n.lk.Lock()
+	n.children = nil
+	n.folded = nil
+	n.refresh = time.Time{}
+	n.lk.Unlock()
+	n.refreshL.Unlock()
+
+	t.lk.Lock()
+	dropped := t.forget(n, children)
+	t.lk.Unlock()
+	log.Printf("[tree] dropped %d nodes below %s", dropped, n.path())
+}
+
+// forget removes n and its loaded subfolders from the lru, and returns the
+// number of nodes removed from memory. Must be called with lock held.
+func (t *treeLRU) forget(n *fsNode, children []*fsNode) int {
+	if e, ok := t.entries[n]; ok {
+		t.count -= e.Value.(*lruEntry).size
+		t.lru.Remove(e)
+		delete(t.entries, n)
+	}
+	delete(t.kept, n)
+	dropped := len(children)
+	for _, c := range children {
+		if _, ok := t.entries[c]; ok {
+			dropped += t.forget(c, c.childList())
+		}
+	}
+	return dropped
+}
+
+// evictable returns true if children of n can be dropped
+func (t *treeLRU) evictable(n *fsNode) bool {
+	if n.isRoot || atomic.LoadInt32(&n.handles) > 0 || t.isKept(n) {
+		return false
+	}
+	if t.fs.pins != nil && t.fs.pins.protects(n.path()) {
+		return false
+	}
+	if t.fs.queue != nil && t.fs.queue.hasPending(n) {
+		return false
+	}
+	return true
+}
+
+// hold marks n and its parents as in use by an open handle, and returns what
+// needs to be passed to release when the handle is closed
+func (n *fsNode) hold() []*fsNode {
+	var held []*fsNode
+	for p := n; p != nil; p = p.getParent() {
+		atomic.AddInt32(&p.handles, 1)
+		held = append(held, p)
+	}
+	for _, p := range held {
+		p.use()
+	}
+	return held
+}
+
+// use records an access to n by a client
+func (n *fsNode) use() {
+	atomic.StoreInt64(&n.used, time.Now().Unix())
+	if n.fs.tree != nil {
+		n.fs.tree.touch(n)
+	}
+}
+
+// lastUse returns when n was last accessed by a client
+func (n *fsNode) lastUse() time.Time {
+	return time.Unix(atomic.LoadInt64(&n.used), 0)
+}
+
+func release(held []*fsNode) {
+	for _, p := range held {
+		atomic.AddInt32(&p.handles, -1)
+	}
+}
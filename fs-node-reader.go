@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/bwlimit"
+)
+
+// readAhead serves reads of a remote file from fixed size blocks fetched
+// with ranged GET requests. Sequential access triggers prefetching of the
+// next blocks in parallel, and recently used blocks are kept around so
+// nearby seeks do not need a new request.
+type readAhead struct {
+	node   *fsNode
+	blob   string
+	size   int64
+	bs     int64 // block size
+	blocks map[int64]*raBlock
+	lk     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	last int64  // end of previous read, to detect sequential access
+	tick uint64 // for lru
+}
+
+type raBlock struct {
+	data  []byte
+	err   error
+	ready chan struct{}
+	used  uint64
+}
+
+func newReadAhead(n *fsNode, limiters []*bwlimit.Limiter) *readAhead {
+	ctx, cancel := context.WithCancel(withLimiters(context.Background(), limiters))
+	blob, size := n.content()
+	return &readAhead{
+		node:   n,
+		blob:   blob,
+		size:   size,
+		bs:     config.ReadAheadBlock,
+		blocks: make(map[int64]*raBlock),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (r *readAhead) Close() error {
+	r.cancel()
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.blocks = make(map[int64]*raBlock)
+	return nil
+}
+
+// block returns block idx, starting its download if needed. Must be called
+// with lock held.
+func (r *readAhead) block(idx int64) *raBlock {
+	r.tick++
+	if b, ok := r.blocks[idx]; ok {
+		b.used = r.tick
+		return b
+	}
+
+	b := &raBlock{ready: make(chan struct{}), used: r.tick}
+	r.blocks[idx] = b
+
+	off := idx * r.bs
+	l := r.bs
+	if off+l > r.size {
+		l = r.size - off
+	}
+	go func() {
+		b.data, b.err = r.node.readBlock(r.ctx, r.blob, off, l)
+		close(b.ready)
+	}()
+	return b
+}
+
+// evict drops least recently used blocks above the limit. Must be called
+// with lock held.
+func (r *readAhead) evict() {
+	max := 2*config.ReadAhead + 2
+	for len(r.blocks) > max {
+		var oldest int64
+		var found *raBlock
+		for idx, b := range r.blocks {
+			if found == nil || b.used < found.used {
+				oldest, found = idx, b
+			}
+		}
+		delete(r.blocks, oldest)
+	}
+}
+
+// ReadAt reads data from the file at offset off, prefetching following
+// blocks if access is sequential
+func (r *readAhead) ReadAt(d []byte, off int64) (int, error) {
+	var n int
+	for len(d) > 0 {
+		if off >= r.size {
+			return n, io.EOF
+		}
+
+		idx := off / r.bs
+
+		r.lk.Lock()
+		b := r.block(idx)
+		if off == r.last {
+			// sequential access, prefetch next blocks
+			for i := int64(1); i <= int64(config.ReadAhead); i++ {
+				if (idx+i)*r.bs >= r.size {
+					break
+				}
+				r.block(idx + i)
+			}
+		}
+		r.evict()
+		r.lk.Unlock()
+
+		select {
+		case <-b.ready:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+
+		if b.err != nil {
+			// forget block so it can be retried
+			r.lk.Lock()
+			if r.blocks[idx] == b {
+				delete(r.blocks, idx)
+			}
+			r.lk.Unlock()
+			return n, b.err
+		}
+
+		c := copy(d, b.data[off-idx*r.bs:])
+		n += c
+		off += int64(c)
+		d = d[c:]
+
+		r.lk.Lock()
+		r.last = off
+		r.lk.Unlock()
+	}
+	return n, nil
+}
+
+// readBlock returns l bytes of blob, the content of the file, starting at
+// off, from the block cache if possible
+func (n *fsNode) readBlock(ctx context.Context, blob string, off, l int64) ([]byte, error) {
+	c := n.fs.cache
+	if c == nil || blob == "" {
+		return n.readRange(ctx, off, l)
+	}
+
+	if data, ok := c.Get(blob, off, l); ok {
+		return data, nil
+	}
+	data, err := n.readRange(ctx, off, l)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Put(blob, off, data); err != nil {
+		log.Printf("[cache] failed to store block: %s", err)
+	}
+	return data, nil
+}
+
+// readRange downloads l bytes of the file starting at off
+func (n *fsNode) readRange(ctx context.Context, off, l int64) ([]byte, error) {
+	buf := make([]byte, l)
+	var got int64
+	var refreshed bool
+	var stalls int
+
+	for got < l {
+		u := n.downloadUrl()
+		if u == "" {
+			// not obtained since restart
+			if err := n.refreshUrl(u); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c, status, err := n.readRangeUrl(ctx, u, off+got, buf[got:])
+		got += int64(c)
+
+		switch {
+		case err == nil:
+		case err == errStalled && stalls < config.StallRetries:
+			// continue from where we are
+			stalls++
+			recordStall(n, u, off+got)
+		case urlExpired(status) && !refreshed:
+			// signed url probably expired, get a new one and try again
+			refreshed = true
+			if err := n.refreshUrl(u); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// readRangeUrl fills buf with data from u starting at off
+func (n *fsNode) readRangeUrl(ctx context.Context, u string, off int64, buf []byte) (int, int, error) {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wd := newWatchdog(time.Duration(config.StallTimeout)*time.Second, cancel)
+	defer wd.stop()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req = req.WithContext(wctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if wd.isStalled() {
+			return 0, 0, errStalled
+		}
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start); err == nil && start != off {
+			return 0, res.StatusCode, fmt.Errorf("download of %s: got range starting at %d instead of %d", n.Name(), start, off)
+		}
+	case http.StatusOK:
+		// range ignored, only acceptable if we asked for the whole file
+		if off != 0 {
+			return 0, res.StatusCode, fmt.Errorf("download of %s: server does not support ranges", n.Name())
+		}
+	default:
+		return 0, res.StatusCode, fmt.Errorf("download of %s failed: %s", n.Name(), res.Status)
+	}
+
+	body := wd.reader(ctx, res.Body, limitersFromContext(ctx))
+	c, err := io.ReadFull(body, buf)
+	if err != nil {
+		if wd.isStalled() {
+			return c, res.StatusCode, errStalled
+		}
+		// connection dropped, truncated data is an error
+		return c, res.StatusCode, fmt.Errorf("download of %s interrupted: %s", n.Name(), err)
+	}
+	return c, res.StatusCode, nil
+}
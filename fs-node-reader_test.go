@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves data with ranged requests, recording requested ranges
+type rangeServer struct {
+	data []byte
+	lk   sync.Mutex
+	reqs map[string]int
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lk.Lock()
+	s.reqs[r.Header.Get("Range")]++
+	s.lk.Unlock()
+	http.ServeContent(w, r, "f.txt", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *rangeServer) requested(rng string) int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.reqs[rng]
+}
+
+func TestReadAhead(t *testing.T) {
+	s := &rangeServer{data: []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD"), reqs: make(map[string]int)}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	n := testFile(testFS(newFakeAPI()), s.data, srv.URL)
+	r := newReadAhead(n, nil)
+	defer r.Close()
+	r.bs = 4
+
+	buf := make([]byte, 4)
+	if _, err := r.ReadAt(buf, 0); err != nil || string(buf) != "0123" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	// sequential access prefetches the next blocks
+	deadline := time.Now().Add(5 * time.Second)
+	for i := int64(1); i <= int64(config.ReadAhead); i++ {
+		rng := fmt.Sprintf("bytes=%d-%d", i*4, i*4+3)
+		for s.requested(rng) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("block %d not prefetched", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// reads spanning blocks, each block downloaded once
+	var res []byte
+	res = append(res, buf...)
+	for off := int64(4); off < int64(len(s.data)); off += 6 {
+		buf := make([]byte, 6)
+		c, _ := r.ReadAt(buf, off)
+		res = append(res, buf[:c]...)
+	}
+	if !bytes.Equal(res, s.data) {
+		t.Errorf("read %q, want %q", res, s.data)
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for rng, c := range s.reqs {
+		if c != 1 {
+			t.Errorf("range %s requested %d times", rng, c)
+		}
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	data := []byte("0123456789")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("answer") {
+		case "range":
+			w.Header().Set("Content-Range", "bytes 2-5/10")
+			w.WriteHeader(http.StatusPartialContent)
+		case "wrong":
+			w.Header().Set("Content-Range", "bytes 0-3/10")
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(data[2:6])
+	}))
+	defer srv.Close()
+
+	n := testFile(testFS(newFakeAPI()), data, srv.URL)
+	ctx := context.Background()
+
+	n.setUrl(srv.URL + "?answer=range")
+	if d, err := n.readRange(ctx, 2, 4); err != nil || string(d) != "2345" {
+		t.Errorf("valid range: got %q, %v", d, err)
+	}
+
+	// server answering with another range than requested
+	n.setUrl(srv.URL + "?answer=wrong")
+	if _, err := n.readRange(ctx, 2, 4); err == nil {
+		t.Errorf("range starting at 0 accepted for offset 2")
+	}
+
+	// server ignoring the range header
+	n.setUrl(srv.URL + "?answer=all")
+	if _, err := n.readRange(ctx, 2, 4); err == nil {
+		t.Errorf("full content accepted for offset 2")
+	}
+	if d, err := n.readRange(ctx, 0, 4); err != nil || string(d) != "2345" {
+		t.Errorf("full content from start: got %q, %v", d, err)
+	}
+}
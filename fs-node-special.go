@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Not all items have downloadable content. Depending on type, they are
+// exposed as read-only files which either fail to download, contain
+// generated content, or are empty.
+const (
+	contentNormal      = iota // data downloaded from storage (or pending upload)
+	contentUnavailable        // file without a download url, reads are refused
+	contentStub               // generated from item info
+	contentEmpty              // zero size placeholder
+)
+
+func (n *fsNode) contentKind() int {
+	switch n.Type {
+	case "folder":
+		return contentEmpty
+	case "file":
+		if n.pendingItem() != nil || n.downloadable() {
+			return contentNormal
+		}
+		return contentUnavailable
+	case "special":
+		return contentStub
+	default:
+		return contentEmpty
+	}
+}
+
+// stub returns the generated content of a special item: an internet
+// shortcut if the item points to a link, else a json descriptor
+func (n *fsNode) stub() []byte {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+
+	for _, k := range []string{"Url", "Link", "Target_Url"} {
+		if u, ok := n.info[k].(string); ok && u != "" {
+			return []byte(fmt.Sprintf("[InternetShortcut]\r\nURL=%s\r\n", u))
+		}
+	}
+
+	info := make(map[string]interface{})
+	for k, v := range n.info {
+		if k == "Download_Url" {
+			continue
+		}
+		info[k] = v
+	}
+	data, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (n *fsNode) stubMime() string {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+
+	for _, k := range []string{"Url", "Link", "Target_Url"} {
+		if u, ok := n.info[k].(string); ok && u != "" {
+			return "application/internet-shortcut"
+		}
+	}
+	return "application/json"
+}
+
+// serveUnavailable answers GET/HEAD requests on files which cannot be
+// downloaded with a proper status instead of a broken body. Returns false if
+// the request is for something else.
+func (fs *DriveFS) serveUnavailable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	n, err := fs.root.find(r.URL.Path, foldCase(r))
+	if err != nil || n.contentKind() != contentUnavailable {
+		return false
+	}
+	http.Error(w, "This file cannot be downloaded", http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/AtOnline/drive-webdav/cfgpath"
+	"github.com/AtOnline/drive-webdav/oauth2"
+)
+
+// Writable handles keep a local copy of the file (the stage) which supports
+// random access. If data is written sequentially from the start it is also
+// uploaded as it comes, otherwise the upload happens from the local copy on
+// close. In write-back mode, the stage is a spool file handed to the queue.
+
+// errIncomplete is returned on close when the client went away before
+// sending all the data
+var errIncomplete = errors.New("upload interrupted before all data was received")
+
+func stagingDir() string {
+	return filepath.Join(cfgpath.GetCacheDir(), "staging")
+}
+
+// cleanStaging removes stage files left over by a previous run
+func cleanStaging() {
+	list, _ := filepath.Glob(filepath.Join(stagingDir(), "stage-*"))
+	for _, p := range list {
+		os.Remove(p)
+	}
+}
+
+func (f *fsNodeFile) fs() *DriveFS {
+	if f.self != nil {
+		return f.self.fs
+	}
+	return f.parent.fs
+}
+
+func (f *fsNodeFile) newStage() error {
+	if q := f.fs().queue; q != nil {
+		sp, id, err := q.spool()
+		if err != nil {
+			return err
+		}
+		f.stage, f.stageId = sp, id
+		return nil
+	}
+
+	if err := cfgpath.EnsureDir(stagingDir()); err != nil {
+		return err
+	}
+	st, err := ioutil.TempFile(stagingDir(), "stage-")
+	if err != nil {
+		return err
+	}
+	f.stage = st
+	return nil
+}
+
+// truncate starts a new empty stage, for new files or O_TRUNC
+func (f *fsNodeFile) truncate() error {
+	f.discardStage()
+	if err := f.newStage(); err != nil {
+		return err
+	}
+	f.stageLen = 0
+	f.dirty = true
+	// when the hash of the current content is known, keep data local until
+	// close, so the upload can be skipped if nothing changed
+	f.stream = f.fs().queue == nil && (f.self == nil || f.self.fs.blobHash(f.self.blob()) == "")
+	f.hash = sha256.New()
+	return nil
+}
+
+// openStage ensures a stage exists, filling it with the current contents of
+// the file if needed
+func (f *fsNodeFile) openStage() error {
+	if f.stage != nil {
+		return nil
+	}
+	if err := f.newStage(); err != nil {
+		return err
+	}
+
+	n, err := f.fetch(f.stage)
+	if err != nil {
+		f.discardStage()
+		return err
+	}
+	f.stageLen = n
+	f.dirty = true
+	f.stream = false
+	f.hash = nil
+	return nil
+}
+
+// fetch copies the current contents of the file to w
+func (f *fsNodeFile) fetch(w io.Writer) (int64, error) {
+	if f.self == nil || f.self.Size() == 0 {
+		return 0, nil
+	}
+	if item := f.self.pendingItem(); item != nil {
+		l, err := os.Open(f.self.fs.queue.dataPath(item.Id))
+		if err != nil {
+			return 0, err
+		}
+		defer l.Close()
+		return io.Copy(w, l)
+	}
+	if !f.self.downloadable() {
+		return 0, os.ErrPermission
+	}
+
+	log.Printf("Downloading %s for update (%d bytes)", f.self.Name(), f.self.Size())
+	ra := newReadAhead(f.self, f.downLimit)
+	defer ra.Close()
+	v := newVerifier(f.self)
+
+	var n int64
+	buf := make([]byte, 256*1024)
+	for n < ra.size {
+		c, err := ra.ReadAt(buf, n)
+		if c > 0 {
+			if err := v.update(n, buf[:c]); err != nil {
+				return n, err
+			}
+			if _, err := w.Write(buf[:c]); err != nil {
+				return n, err
+			}
+			n += int64(c)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	if n != ra.size {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// written is called after data has been written to the stage at pos
+func (f *fsNodeFile) written(pos int64, d []byte) {
+	sequential := pos == f.stageLen
+	if end := pos + int64(len(d)); end > f.stageLen {
+		f.stageLen = end
+	}
+	f.dirty = true
+
+	if f.hash != nil {
+		if sequential {
+			f.hash.Write(d)
+		} else {
+			f.hash = nil
+		}
+	}
+
+	if !f.stream {
+		return
+	}
+	if !sequential {
+		log.Printf("Non sequential write, upload will happen on close")
+		f.stream = false
+		f.dropUpload()
+		return
+	}
+
+	if f.upload == nil {
+		up, err := f.newUpload()
+		if err == nil && f.expect >= 0 {
+			err = f.fs().checkNet(up.SetSize(f.expect))
+		}
+		if err != nil {
+			log.Printf("Failed to start upload, will retry on close: %s", err)
+			f.stream = false
+			return
+		}
+		f.upload = up
+	}
+	if _, err := f.upload.Write(d); f.fs().checkNet(err) != nil {
+		log.Printf("Upload failed, will retry on close: %s", err)
+		f.stream = false
+		f.dropUpload()
+	}
+}
+
+func (f *fsNodeFile) newUpload() (*oauth2.Upload, error) {
+	var up *oauth2.Upload
+	var err error
+	if f.self == nil {
+		up, err = f.parent.fs.newUpload("Drive/Item/"+url.PathEscape(f.parent.Id)+":upload", oauth2.RestParam{"filename": decodeName(f.name)})
+	} else {
+		up, err = f.self.overwrite()
+	}
+	if err != nil {
+		return nil, err
+	}
+	up.ContentType = f.mime
+	up.Limiters = f.upLimit
+	return up, nil
+}
+
+// sum returns the hex encoded sha256 of the staged data
+func (f *fsNodeFile) sum() (string, error) {
+	if f.hash == nil {
+		// writes were not sequential, hash local copy
+		f.hash = sha256.New()
+		if _, err := io.Copy(f.hash, io.NewSectionReader(f.stage, 0, f.stageLen)); err != nil {
+			f.hash = nil
+			return "", err
+		}
+	}
+	return hex.EncodeToString(f.hash.Sum(nil)), nil
+}
+
+func (f *fsNodeFile) finalizeUpload() error {
+	if !f.dirty {
+		return nil
+	}
+	if f.incomplete() {
+		log.Printf("Upload interrupted after %d bytes, discarding", f.stageLen)
+		return errIncomplete
+	}
+
+	sum, err := f.sum()
+	if err != nil {
+		return err
+	}
+
+	if q := f.fs().queue; q != nil {
+		node, err := q.commit(f.stage, f.stageId, f.parent, f.self, f.name, sum, f.mime, requestClient(f.req))
+		f.stage = nil
+		f.dirty = false
+		if err != nil {
+			return err
+		}
+		f.self = node
+		return nil
+	}
+
+	if f.self != nil && f.self.fs.blobHash(f.self.blob()) == sum {
+		// same content as what is already there
+		log.Printf("Content of %s unchanged, skipping upload", f.self.Name())
+		f.dirty = false
+		f.dropUpload()
+		return nil
+	}
+
+	up := f.upload
+	if up == nil || !f.stream || up.Len() != f.stageLen {
+		// upload from local copy
+		f.dropUpload()
+		up, err = f.newUpload()
+		if err != nil {
+			return err
+		}
+		if err := up.SetSize(f.stageLen); err != nil {
+			return f.fs().checkNet(err)
+		}
+		if _, err := io.Copy(up, io.NewSectionReader(f.stage, 0, f.stageLen)); err != nil {
+			abortUpload(up)
+			return f.fs().checkNet(err)
+		}
+	}
+
+	final, err := up.Complete()
+	err = f.fs().checkNet(err)
+	f.upload = nil
+	f.stream = false
+	if err != nil {
+		abortUpload(up)
+		return err
+	}
+	f.dirty = false
+
+	// add child if new upload
+	if f.self == nil {
+		f.parent.load()
+		f.self = f.parent.addChild(final.Data.(map[string]interface{}), "")
+	} else {
+		f.self.store(final.Data.(map[string]interface{}))
+	}
+	if f.self != nil {
+		f.self.fs.setBlobHash(f.self.blob(), sum)
+		f.self.lk.Lock()
+		if f.self.mime == "" {
+			f.self.mime = up.ContentType
+		}
+		f.self.lk.Unlock()
+	}
+	return nil
+}
+
+// incomplete returns true if the request writing data ended before the
+// declared length was received
+func (f *fsNodeFile) incomplete() bool {
+	if f.expect >= 0 {
+		return f.stageLen != f.expect
+	}
+	// length unknown, see if the client is still there
+	return f.req != nil && f.req.Err() != nil
+}
+
+func (f *fsNodeFile) discardStage() {
+	if f.stage == nil {
+		return
+	}
+	f.stage.Close()
+	os.Remove(f.stage.Name())
+	f.stage = nil
+	f.stageLen = 0
+	f.dirty = false
+	f.dropUpload()
+	f.stream = false
+}
+
+// dropUpload aborts the upload streamed so far, if any
+func (f *fsNodeFile) dropUpload() {
+	if f.upload == nil {
+		return
+	}
+	abortUpload(f.upload)
+	f.upload = nil
+}
+
+// abortUpload releases data of an upload which will not complete
+func abortUpload(up *oauth2.Upload) {
+	if err := up.Abort(); err != nil {
+		log.Printf("Failed to abort upload: %s", err)
+	}
+}
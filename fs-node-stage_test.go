@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestCreateOnLock checks that locking a path which does not exist does not
+// upload an empty file, while an empty PUT does
+func TestCreateOnLock(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fs := testFS(newFakeAPI())
+	q := testQueue(t, fs)
+
+	for _, method := range []string{"LOCK", "PUT"} {
+		r := httptest.NewRequest(method, "/Test/a/new.txt", nil)
+		ctx := context.WithValue(context.Background(), ctxKeyRequest, r)
+		f, err := fs.OpenFile(ctx, "/Test/a/new.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", method, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%s: %s", method, err)
+		}
+
+		_, err = fs.Stat(ctx, "/Test/a/new.txt")
+		if method == "LOCK" && (err == nil || len(q.items) != 0) {
+			t.Errorf("LOCK uploaded an empty file")
+		}
+		if method == "PUT" && (err != nil || len(q.items) != 1) {
+			t.Errorf("empty PUT not uploaded: %v", err)
+		}
+	}
+}
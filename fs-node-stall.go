@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/bwlimit"
+)
+
+// Downloads can hang forever on a half dead connection. A watchdog cancels
+// transfers not making progress for a while so the range can be requested
+// again.
+
+var errStalled = errors.New("download stalled")
+
+type watchdog struct {
+	last    int64 // unix nano time of last progress
+	paused  int32 // waiting for something else than the connection
+	stalled int32
+	done    chan struct{}
+}
+
+// newWatchdog calls cancel if touch is not called for timeout. A zero
+// timeout disables it.
+func newWatchdog(timeout time.Duration, cancel func()) *watchdog {
+	w := &watchdog{done: make(chan struct{})}
+	w.touch()
+	if timeout <= 0 {
+		return w
+	}
+
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-t.C:
+				if atomic.LoadInt32(&w.paused) > 0 {
+					continue
+				}
+				if time.Since(time.Unix(0, atomic.LoadInt64(&w.last))) > timeout {
+					atomic.StoreInt32(&w.stalled, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *watchdog) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+func (w *watchdog) stop() {
+	close(w.done)
+}
+
+func (w *watchdog) isStalled() bool {
+	return atomic.LoadInt32(&w.stalled) == 1
+}
+
+// pause suspends the timeout until resume is called
+func (w *watchdog) pause() {
+	atomic.AddInt32(&w.paused, 1)
+}
+
+func (w *watchdog) resume() {
+	w.touch()
+	atomic.AddInt32(&w.paused, -1)
+}
+
+// reader returns a reader signaling progress each time data is read, and
+// slowed down by limiters. Time spent waiting for limiters does not count
+// towards the timeout.
+func (w *watchdog) reader(ctx context.Context, r io.Reader, limiters []*bwlimit.Limiter) io.Reader {
+	return &watchdogReader{w: w, ctx: ctx, r: r, limiters: limiters}
+}
+
+type watchdogReader struct {
+	w        *watchdog
+	ctx      context.Context
+	r        io.Reader
+	limiters []*bwlimit.Limiter
+}
+
+func (r *watchdogReader) Read(p []byte) (int, error) {
+	if len(p) > 32*1024 {
+		// keep limiter waits short and smooth
+		p = p[:32*1024]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.touch()
+		if len(r.limiters) > 0 {
+			r.w.pause()
+			werr := bwlimit.Wait(r.ctx, n, r.limiters...)
+			r.w.resume()
+			if werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+// stall statistics, by storage host
+var (
+	stallCount  int
+	stallByHost = make(map[string]int)
+	stallL      sync.Mutex
+)
+
+func recordStall(n *fsNode, u string, off int64) {
+	host := "?"
+	if p, err := url.Parse(u); err == nil {
+		host = p.Host
+	}
+
+	stallL.Lock()
+	stallCount++
+	stallByHost[host]++
+	total, forHost := stallCount, stallByHost[host]
+	stallL.Unlock()
+
+	log.Printf("[stall] download of %s stalled at offset %d on %s, retrying (%d stalls on this host, %d total)", n.Name(), off, host, forHost, total)
+}
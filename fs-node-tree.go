@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// The node tree is shared by all requests. Each node's lk protects its
+// children map, the info fields updated by store(), the load error and the
+// pending upload, and is never held while taking another node's lock. The
+// identity of a node (Id, Type, driveId) is set before it is added to the
+// tree and never changes. Loads of a node are serialized by
+// refreshL: callers arriving while a load is running wait for it, then find
+// fresh data and return, so concurrent requests on a folder cause a single
+// listing request. A reload builds a new children map and swaps it in, so
+// readers never see a partially filled map.
+
+// child returns the child of n called name
+func (n *fsNode) child(name string) (*fsNode, bool) {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	c, ok := n.children[name]
+	return c, ok
+}
+
+// lookup returns the child of n matching name, as requested by a client. An
+// exact match comes first, then a child whose name only differs in unicode
+// normalization, or case if fold is set (see matchKey). If several children
+// match, the first name in byte order wins.
+func (n *fsNode) lookup(name string, fold bool) (*fsNode, bool) {
+	if c, ok := n.child(name); ok {
+		return c, true
+	}
+	k := matchKey(name, fold)
+
+	n.lk.RLock()
+	index, built := n.folded[fold]
+	if built {
+		c, ok := n.children[index[k]]
+		n.lk.RUnlock()
+		return c, ok
+	}
+	n.lk.RUnlock()
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.children == nil {
+		return nil, false
+	}
+	index, built = n.folded[fold]
+	if !built {
+		index = make(map[string]string, len(n.children))
+		for cname := range n.children {
+			ck := matchKey(cname, fold)
+			if o, found := index[ck]; found && o < cname {
+				continue
+			}
+			index[ck] = cname
+		}
+		if n.folded == nil {
+			n.folded = make(map[bool]map[string]string, 2)
+		}
+		n.folded[fold] = index
+	}
+	cname, ok := index[k]
+	if !ok {
+		return nil, false
+	}
+	return n.children[cname], true
+}
+
+// lookupLoaded is lookup on a folder which was just revalidated. If the
+// tree LRU dropped its children meanwhile, it is loaded again.
+func (n *fsNode) lookupLoaded(name string, fold bool) (*fsNode, bool) {
+	c, ok := n.lookup(name, fold)
+	if !ok && !n.loaded() {
+		n.revalidate()
+		c, ok = n.lookup(name, fold)
+	}
+	return c, ok
+}
+
+// childList returns a snapshot of n's children
+func (n *fsNode) childList() []*fsNode {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	res := make([]*fsNode, 0, len(n.children))
+	for _, c := range n.children {
+		res = append(res, c)
+	}
+	return res
+}
+
+// childrenById returns n's current children by item id, for reuse by a
+// reload
+func (n *fsNode) childrenById() map[string]*fsNode {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	res := make(map[string]*fsNode, len(n.children))
+	for _, c := range n.children {
+		if c.Id != "" {
+			res[c.Id] = c
+		}
+	}
+	return res
+}
+
+// setChildren swaps in the children built by a load, changed if they differ
+// from the previous load
+func (n *fsNode) setChildren(children map[string]*fsNode, changed bool) {
+	n.lk.Lock()
+	n.children = children
+	n.folded = nil
+	n.lk.Unlock()
+	if changed {
+		n.fs.meta.touch(n)
+	}
+	if n.fs.tree != nil {
+		n.fs.tree.loaded(n, len(children))
+	}
+}
+
+// putChild adds c to n's children, under its current name
+func (n *fsNode) putChild(c *fsNode) {
+	name := c.Name()
+	n.lk.Lock()
+	if n.children == nil {
+		n.children = make(map[string]*fsNode)
+	}
+	_, replaced := n.children[name]
+	n.children[name] = c
+	n.folded = nil
+	n.lk.Unlock()
+	n.fs.meta.touch(n)
+	if n.fs.tree != nil && !replaced {
+		n.fs.tree.grow(n, 1)
+	}
+}
+
+// removeChild removes c from n's children, if still there
+func (n *fsNode) removeChild(c *fsNode) {
+	name := c.Name()
+	n.lk.Lock()
+	removed := n.children[name] == c
+	if removed {
+		delete(n.children, name)
+		n.folded = nil
+	}
+	n.lk.Unlock()
+	n.fs.meta.touch(n)
+	if n.fs.tree != nil && removed {
+		n.fs.tree.grow(n, -1)
+	}
+}
+
+// replaceChild puts c in place of old in n's children, if still there. c
+// must have the same name as old.
+func (n *fsNode) replaceChild(old, c *fsNode) {
+	name := old.Name()
+	n.lk.Lock()
+	if n.children[name] == old {
+		n.children[name] = c
+	}
+	n.lk.Unlock()
+	n.fs.meta.touch(n)
+}
+
+func (n *fsNode) getParent() *fsNode {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	return n.parent
+}
+
+// moveTo moves n in the tree to folder tgt, as name
+func (n *fsNode) moveTo(tgt *fsNode, name string) {
+	if p := n.getParent(); p != nil {
+		p.removeChild(n)
+	}
+	n.lk.Lock()
+	n.name = name
+	n.parent = tgt
+	n.lk.Unlock()
+	tgt.putChild(n)
+}
+
+// loaded returns true if n's children have been loaded
+func (n *fsNode) loaded() bool {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	return n.children != nil
+}
+
+// path returns the path of n in the tree
+func (n *fsNode) path() string {
+	if n.isRoot {
+		return "/"
+	}
+	var parts []string
+	for p := n; p != nil && !p.isRoot; p = p.getParent() {
+		parts = append(parts, p.Name())
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// version returns a summary of n's info, which changes when the item is
+// modified
+func (n *fsNode) version() string {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	return n.versionLocked()
+}
+
+func (n *fsNode) versionLocked() string {
+	return fmt.Sprintf("%s/%s/%s/%d/%d", n.name, n.Blob, n.mime, n.size, n.LastModified.UnixNano())
+}
+
+// content returns the blob and size of a file
+func (n *fsNode) content() (string, int64) {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	return n.Blob, n.size
+}
+
+func (n *fsNode) blob() string {
+	blob, _ := n.content()
+	return blob
+}
+
+// pendingItem returns the write-back upload of n's contents, if any
+func (n *fsNode) pendingItem() *queueItem {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	return n.pending
+}
+
+func (n *fsNode) setPending(item *queueItem) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.pending = item
+}
+
+// loadErr returns the error of the last load of n, if any
+func (n *fsNode) loadErr() error {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
+	return n.err
+}
+
+func (n *fsNode) setErr(err error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.err = err
+}
+
+// uniqueName returns oname, varied if needed to not collide with an entry
+// of children, and the suffix used (see dupName)
+func uniqueName(children map[string]*fsNode, oname string, folder bool) (string, int) {
+	name := oname
+	cnt := 1
+	for {
+		if _, found := children[name]; !found {
+			return name, cnt
+		}
+		// need to vary name
+		cnt++
+		name = dupName(oname, cnt, folder)
+		log.Printf("retry: %s", name)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AtOnline/drive-webdav/oauth2"
+)
+
+// fakeAPI serves the subset of the Drive API used by the node tree from
+// memory
+type fakeAPI struct {
+	lk     sync.Mutex
+	items  map[string]*fakeItem
+	refuse int // next listings answered with 429 Too Many Requests
+	lists  int // listings served
+}
+
+type fakeItem struct {
+	id, parent, name, typ string
+}
+
+func newFakeAPI() *fakeAPI {
+	a := &fakeAPI{items: make(map[string]*fakeItem)}
+	a.add("root", "", "", "folder")
+	for _, d := range []string{"a", "b"} {
+		a.add(d, "root", d, "folder")
+		a.add(d+"-sub", d, "sub", "folder")
+		for i := 0; i < 10; i++ {
+			a.add(fmt.Sprintf("%s-f%d", d, i), d, fmt.Sprintf("f%d.txt", i), "file")
+			a.add(fmt.Sprintf("%s-sub-f%d", d, i), d+"-sub", fmt.Sprintf("f%d.txt", i), "file")
+		}
+	}
+	return a
+}
+
+func (a *fakeAPI) add(id, parent, name, typ string) {
+	a.items[id] = &fakeItem{id: id, parent: parent, name: name, typ: typ}
+}
+
+func (a *fakeAPI) info(it *fakeItem) map[string]interface{} {
+	res := map[string]interface{}{"Drive_Item__": it.id, "Name": it.name, "Type": it.typ, "Size": "0"}
+	if it.typ == "file" {
+		res["Blob__"] = "blob-" + it.id
+		res["Mime"] = "text/plain"
+		res["Download_Url"] = "https://example.com/" + it.id
+	}
+	return res
+}
+
+// names returns the sorted names of the children of parent
+func (a *fakeAPI) names(parent string) []string {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	var res []string
+	for _, it := range a.items {
+		if it.parent == parent {
+			res = append(res, it.name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (a *fakeAPI) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := strings.TrimPrefix(r.URL.Path, "/_special/rest/")
+	param := make(map[string]interface{})
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&param)
+	}
+
+	a.lk.Lock()
+	if strings.HasSuffix(req, "/Item") && r.Method == "GET" {
+		if a.refuse > 0 {
+			a.refuse--
+			a.lk.Unlock()
+			return &http.Response{StatusCode: http.StatusTooManyRequests, Header: make(http.Header), Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}
+		a.lists++
+	}
+	data, err := a.serve(r.Method, req, r.URL.Query(), param)
+	a.lk.Unlock()
+
+	res := map[string]interface{}{"result": "success", "data": data}
+	if err != nil {
+		res = map[string]interface{}{"result": "error", "error": err.Error()}
+	}
+	body, _ := json.Marshal(res)
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewReader(body)), Request: r}, nil
+}
+
+func (a *fakeAPI) serve(method, req string, query map[string][]string, param map[string]interface{}) (interface{}, error) {
+	switch {
+	case req == "Drive":
+		return []interface{}{map[string]interface{}{"Drive__": "drv", "Name": "Test", "Root": a.info(a.items["root"])}}, nil
+	case req == "Drive/drv/Item":
+		list := []interface{}{}
+		for _, it := range a.items {
+			if len(query["Parent_Drive_Item__"]) > 0 && it.parent == query["Parent_Drive_Item__"][0] {
+				list = append(list, a.info(it))
+			}
+		}
+		return list, nil
+	case strings.HasPrefix(req, "Drive/Item/"):
+		id := strings.TrimPrefix(req, "Drive/Item/")
+		move := strings.HasSuffix(id, ":moveTo")
+		id = strings.TrimSuffix(id, ":moveTo")
+		it, ok := a.items[id]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		switch {
+		case method == "PATCH":
+			it.name = param["Name"].(string)
+		case method == "POST" && move:
+			it.parent = param["target"].(string)
+			it.name = param["rename"].(string)
+		case method != "GET":
+			return nil, fmt.Errorf("unsupported %s %s", method, req)
+		}
+		return a.info(it), nil
+	}
+	return nil, fmt.Errorf("unsupported %s %s", method, req)
+}
+
+func TestMain(m *testing.M) {
+	// small tree, so folders get dropped and reloaded during tests
+	config.MaxNodes = 30
+	os.Exit(m.Run())
+}
+
+// testFS returns a file system on api, without disk state
+func testFS(api *fakeAPI) *DriveFS {
+	o := &oauth2.OAuth2{}
+	o.Client.Transport = api
+
+	fs := &DriveFS{
+		c:       o,
+		hashes:  make(map[string]string),
+		changes: newChangeFeed(),
+		names:   newNameMap(""),
+	}
+	fs.root = newRoot(fs)
+	if config.MaxNodes > 0 {
+		fs.tree = newTreeLRU(fs)
+	}
+	return fs
+}
+
+// TestTreeConcurrency runs lookups, listings, renames, moves and reloads in
+// parallel, to be run with -race
+func TestTreeConcurrency(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	api := newFakeAPI()
+	fs := testFS(api)
+	ctx := context.Background()
+
+	const rounds = 50
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	for _, d := range []string{"a", "b"} {
+		d := d
+		run(func(i int) {
+			fs.Stat(ctx, fmt.Sprintf("/Test/%s/sub/f%d.txt", d, i%10))
+			fs.Stat(ctx, fmt.Sprintf("/Test/%s/F%d.TXT", d, i%10))
+		})
+		run(func(i int) {
+			f, err := fs.OpenFile(ctx, "/Test/"+d+"/sub", os.O_RDONLY, 0)
+			if err != nil {
+				return
+			}
+			list, _ := f.Readdir(-1)
+			for _, fi := range list {
+				fi.Name()
+				fi.Size()
+				fi.ModTime()
+			}
+			f.Close()
+		})
+		run(func(i int) {
+			// rename back and forth
+			from, to := "f1.txt", "renamed.txt"
+			if i%2 == 1 {
+				from, to = to, from
+			}
+			fs.Rename(ctx, "/Test/"+d+"/"+from, "/Test/"+d+"/"+to)
+		})
+		run(func(i int) {
+			fs.refresh("/Test/" + d)
+			fs.root.get("/Test/" + d + "/sub")
+		})
+	}
+	run(func(i int) {
+		// move between folders
+		from, to := "/Test/a/f5.txt", "/Test/b/moved.txt"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		fs.Rename(ctx, from, to)
+	})
+	run(func(i int) {
+		fs.refresh("/")
+		for _, c := range fs.root.childList() {
+			c.path()
+			c.loadErr()
+		}
+	})
+	wg.Wait()
+
+	// the tree must match the API once reloaded
+	if err := fs.refresh("/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"a", "b", "a-sub", "b-sub"} {
+		p := "/Test/" + strings.Replace(d, "-", "/", 1)
+		n, err := fs.root.get(p)
+		if err != nil {
+			t.Fatalf("%s: %s", p, err)
+		}
+		held := n.hold() // not to be dropped by the tree LRU meanwhile
+		n.revalidate()
+		var names []string
+		for _, c := range n.childList() {
+			names = append(names, c.Name())
+		}
+		release(held)
+		sort.Strings(names)
+		if want := api.names(d); strings.Join(names, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got %v, want %v", path.Clean(p), names, want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Download urls are signed and expire after some time. They are refreshed
+// through the API when storage refuses them.
+
+// urls older than that are refreshed before being handed to clients
+const urlFreshFor = 5 * time.Minute
+
+var errChangedRemotely = errors.New("file was modified on server while being read")
+
+// downloadUrl returns the current download url of the node
+func (n *fsNode) downloadUrl() string {
+	n.urlL.Lock()
+	defer n.urlL.Unlock()
+	return n.url
+}
+
+// setUrl records a download url obtained from the API
+func (n *fsNode) setUrl(u string) {
+	n.urlL.Lock()
+	defer n.urlL.Unlock()
+	n.url = u
+	n.urlTime = time.Now()
+	n.urlLater = false
+}
+
+// downloadable returns true if the file has a download url, possibly not
+// obtained yet
+func (n *fsNode) downloadable() bool {
+	n.urlL.Lock()
+	defer n.urlL.Unlock()
+	return n.url != "" || n.urlLater
+}
+
+// refreshUrl fetches a new download url for the item, unless it was already
+// refreshed since stale was obtained. Refreshes are serialized by urlNewL,
+// urlL is not held during the request so readers are not blocked.
+func (n *fsNode) refreshUrl(stale string) error {
+	n.urlNewL.Lock()
+	defer n.urlNewL.Unlock()
+
+	if n.downloadUrl() != stale {
+		// another request did it for us
+		return nil
+	}
+
+	res, err := n.fs.rest("Drive/Item/"+url.PathEscape(n.Id), "GET", nil)
+	if err != nil {
+		return err
+	}
+	info := res.Data.(map[string]interface{})
+	if blob, _ := info["Blob__"].(string); blob != n.blob() {
+		// url would give us different data
+		return errChangedRemotely
+	}
+
+	u, _ := info["Download_Url"].(string)
+	if u == "" {
+		return errors.New("no download url available")
+	}
+
+	n.urlL.Lock()
+	defer n.urlL.Unlock()
+	if n.url != stale {
+		// set by a listing meanwhile, which is at least as recent
+		return nil
+	}
+	log.Printf("Refreshed download url of %s", n.Name())
+	n.url = u
+	n.urlTime = time.Now()
+	return nil
+}
+
+// freshUrl returns a download url that is valid for a while, for clients
+// which download directly from storage
+func (n *fsNode) freshUrl() (string, error) {
+	n.urlL.Lock()
+	u, t := n.url, n.urlTime
+	n.urlL.Unlock()
+
+	if time.Since(t) > urlFreshFor {
+		if err := n.refreshUrl(u); err != nil {
+			return "", err
+		}
+	}
+	return n.downloadUrl(), nil
+}
+
+// urlExpired returns true if a download response status means the signed
+// url is no longer valid
+func urlExpired(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusGone:
+		return true
+	default:
+		return false
+	}
+}
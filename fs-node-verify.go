@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+)
+
+var errIntegrity = errors.New("downloaded data does not match file hash")
+
+// verifier follows data read sequentially from the start of a file, and
+// checks it against the file's size, and hash if the API provided one, when
+// the end is reached. Non sequential access disables it.
+type verifier struct {
+	node   *fsNode
+	blob   string
+	size   int64
+	pos    int64
+	expect string // sha256 of the blob, if known
+	h      hash.Hash
+	active bool
+}
+
+func newVerifier(n *fsNode) *verifier {
+	blob, size := n.content()
+	v := &verifier{node: n, blob: blob, size: size, expect: n.fs.blobHash(blob), active: true}
+	if v.expect != "" {
+		v.h = sha256.New()
+	}
+	return v
+}
+
+// update is called with data read at off, and returns an error if data
+// turns out to be corrupted
+func (v *verifier) update(off int64, d []byte) error {
+	if !v.active {
+		return nil
+	}
+	if off != v.pos {
+		// not sequential, can't check
+		v.active = false
+		return nil
+	}
+
+	if v.h != nil {
+		v.h.Write(d)
+	}
+	v.pos += int64(len(d))
+	if v.pos > v.size {
+		v.active = false
+		return fmt.Errorf("download of %s returned more data than expected", v.node.Name())
+	}
+	if v.pos < v.size {
+		return nil
+	}
+
+	// reached end, check hash
+	v.active = false
+	if v.h == nil {
+		// no reference to check against
+		return nil
+	}
+	sum := hex.EncodeToString(v.h.Sum(nil))
+	if v.expect != sum {
+		log.Printf("Integrity check failed for %s: expected sha256 %s, got %s", v.node.Name(), v.expect, sum)
+		v.node.forgetBlocks(v.blob, v.size)
+		return errIntegrity
+	}
+	return nil
+}
+
+// forgetBlocks removes cached data of a blob, after it was found corrupted
+func (n *fsNode) forgetBlocks(blob string, size int64) {
+	c := n.fs.cache
+	if c == nil {
+		return
+	}
+	for off := int64(0); off < size; off += config.ReadAheadBlock {
+		c.Remove(blob, off)
+	}
+}
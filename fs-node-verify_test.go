@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// testFile returns a file node with data as content, downloaded from u
+func testFile(fs *DriveFS, data []byte, u string) *fsNode {
+	parent := &fsNode{fs: fs, Id: "p", Type: "folder", driveId: "drv"}
+	return makeNode(map[string]interface{}{
+		"Drive_Item__": "f",
+		"Type":         "file",
+		"Size":         strconv.Itoa(len(data)),
+		"Blob__":       "blob-f",
+		"Mime":         "text/plain",
+		"Download_Url": u,
+	}, "f.txt", parent)
+}
+
+func TestVerifier(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fs := testFS(newFakeAPI())
+	data := []byte("hello world")
+	n := testFile(fs, data, "")
+
+	// no known hash, only the size is checked
+	v := newVerifier(n)
+	if err := v.update(0, data); err != nil {
+		t.Errorf("without hash: %s", err)
+	}
+	v = newVerifier(n)
+	if err := v.update(0, append(data, '!')); err == nil {
+		t.Errorf("extra data accepted")
+	}
+
+	sum := sha256.Sum256(data)
+	fs.setBlobHash("blob-f", hex.EncodeToString(sum[:]))
+
+	v = newVerifier(n)
+	if err := v.update(0, data[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.update(5, data[5:]); err != nil {
+		t.Errorf("matching data rejected: %s", err)
+	}
+
+	v = newVerifier(n)
+	if err := v.update(0, []byte("hello World")); err != errIntegrity {
+		t.Errorf("hash mismatch: got %v, want %v", err, errIntegrity)
+	}
+
+	// non sequential reads can't be checked
+	v = newVerifier(n)
+	v.update(0, data[:5])
+	v.update(8, data[8:])
+	if err := v.update(5, []byte("XXX")); err != nil {
+		t.Errorf("non sequential read checked: %s", err)
+	}
+}
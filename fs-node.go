@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/sha256"
 	"log"
 	"net/url"
 	"os"
@@ -17,62 +17,108 @@ import (
 )
 
 type fsNode struct {
+	used int64 // unix time of last access, see use(). First for alignment of atomic ops.
+
 	fs  *DriveFS
-	err error // if any
+	err error // of the last load, if any, see loadErr()
 
 	// info from API
 	name         string
 	Id           string
 	Blob         string
 	Type         string
-	url          string
+	url          string // use downloadUrl() to access
 	mime         string
 	size         int64
 	LastModified time.Time
 
 	// in case of directory, "children" is populated
 	children map[string]*fsNode
+	folded   map[bool]map[string]string // names of children by matchKey, by case folding, built on demand
+	lk       sync.RWMutex               // see fs-node-tree.go
+
+	pending *queueItem             // upload waiting in write-back queue, see pendingItem()
+	info    map[string]interface{} // raw info, for special items
 
 	loadOnce sync.Once
-	driveId  string
+	driveId  string // set before the node is added to the tree, never changes
 	parent   *fsNode
 	isRoot   bool
 	refresh  time.Time
 	refreshL sync.Mutex
+	handles  int32     // open handles on this node or below, see hold()
+	urlTime  time.Time // when url was obtained
+	urlLater bool      // file has a download url not obtained yet, see metaStore
+	urlL     sync.Mutex
+	urlNewL  sync.Mutex // serializes refreshUrl, held during the request
 }
 
+// store updates the node with item info from the API. The name is left
+// alone, as it may differ from the item's to avoid collisions. The identity
+// of a node is set by makeNode and never changes.
 func (r *fsNode) store(vM map[string]interface{}) {
-	r.Id = vM["Drive_Item__"].(string)
-	r.Type = vM["Type"].(string)
+	// size is returned as string
+	sizeStr, _ := vM["Size"].(string)
+	size, _ := strconv.ParseInt(sizeStr, 0, 64)
+
+	r.lk.Lock()
+	before := r.versionLocked()
 	if r.Type == "file" {
-		r.Blob = vM["Blob__"].(string)      // directories/etc won't have a blob, ignore error
-		r.url = vM["Download_Url"].(string) // only for files
-		r.mime = vM["Mime"].(string)
+		// values are null for items without content
+		r.Blob, _ = vM["Blob__"].(string)
+		r.mime, _ = vM["Mime"].(string)
 	}
-	r.name = vM["Name"].(string)
 	r.LastModified = parseTime(vM["Last_Modified"])
-
-	// size is returned as string
-	size, _ := strconv.ParseInt(vM["Size"].(string), 0, 64)
+	if r.Type != "file" && r.Type != "folder" {
+		r.info = vM
+	}
 	r.size = size
+	blob := r.Blob
+	changed := r.versionLocked() != before
+	r.lk.Unlock()
+	if r.fs != nil && changed {
+		r.fs.meta.touch(r.getParent())
+	}
+
+	if r.Type == "file" {
+		// only for files, "" if the item cannot be downloaded
+		u, _ := vM["Download_Url"].(string)
+		r.setUrl(u)
+	}
+	if h, ok := vM["Hash"].(string); ok && len(h) == sha256.Size*2 && r.fs != nil {
+		// content hash, if exposed by the API
+		r.fs.setBlobHash(blob, strings.ToLower(h))
+	}
 }
 
 func makeNode(vM map[string]interface{}, name string, parent *fsNode) *fsNode {
-	r := &fsNode{}
+	r := &fsNode{fs: parent.fs, Id: vM["Drive_Item__"].(string), Type: vM["Type"].(string)}
 	r.store(vM)
 
 	// set values
 	r.name = name
 	r.parent = parent
 	r.driveId = parent.driveId
-	r.fs = parent.fs
+	if r.Type == "file" {
+		// info is fresh
+		r.refresh = time.Now()
+	}
 
 	return r
 }
 
 func (n *fsNode) load() {
 	// perform load
-	n.loadOnce.Do(n.loadInternal)
+	n.loadOnce.Do(func() {
+		n.refreshL.Lock()
+		defer n.refreshL.Unlock()
+		if n.Type == "folder" && n.fs.meta.restore(n) {
+			// serve the last known state, and check it in the background
+			go n.fs.reload(n)
+			return
+		}
+		n.loadInternal()
+	})
 }
 
 func (n *fsNode) reloadData() {
@@ -81,7 +127,7 @@ func (n *fsNode) reloadData() {
 	n.refreshL.Lock()
 	defer n.refreshL.Unlock()
 
-	if time.Since(n.refresh) < 5*time.Second {
+	if time.Since(n.lastRefresh()) < 5*time.Second {
 		// do not perform reload if did reload less than 5s ago
 		return
 	}
@@ -91,90 +137,224 @@ func (n *fsNode) reloadData() {
 
 func (n *fsNode) addChild(infoMap map[string]interface{}, oname string) *fsNode {
 	if oname == "" {
-		oname = infoMap["Name"].(string)
+		oname = encodeName(infoMap["Name"].(string))
 	}
-	name := oname
-	cnt := 1
-	for {
-		if _, found := n.children[name]; !found {
-			break
+	node := makeNode(infoMap, oname, n)
+
+	n.lk.Lock()
+	if n.children == nil {
+		n.children = make(map[string]*fsNode)
+	}
+	var k int
+	holder := n.children[oname]
+	node.name, k = uniqueName(n.children, oname, node.Type == "folder")
+	n.children[node.name] = node
+	n.folded = nil
+	n.lk.Unlock()
+
+	if k > 1 {
+		// remember who is who
+		if holder != nil {
+			n.fs.names.record(n.driveId, n.Id, holder.Id, 1)
 		}
-		// need to vary name
-		cnt++
-		name = fmt.Sprintf("%s (%d)", oname, cnt)
-		log.Printf("retry: %s", name)
+		n.fs.names.record(n.driveId, n.Id, node.Id, k)
 	}
-	node := makeNode(infoMap, name, n)
-	if node != nil {
-		n.children[name] = node
+
+	n.fs.meta.touch(n)
+	if n.fs.tree != nil {
+		n.fs.tree.grow(n, 1)
 	}
 	return node
 }
 
+// childNames returns names to use for the items of a listing, by item id.
+// onames are the names of items, if not their Drive name.
+func (n *fsNode) childNames(prev map[string]*fsNode, list []map[string]interface{}, onames []string) map[string]string {
+	items := make([]nameItem, len(list))
+	for i, infoMap := range list {
+		it := nameItem{id: infoMap["Drive_Item__"].(string), folder: infoMap["Type"] == "folder"}
+		if onames != nil {
+			it.name = onames[i]
+		} else {
+			it.name = encodeName(infoMap["Name"].(string))
+		}
+		if c, ok := prev[it.id]; ok {
+			it.current = c.Name()
+		}
+		items[i] = it
+	}
+	return n.fs.names.assign(n.driveId, n.Id, items)
+}
+
+// loadChild adds a child named oname to children, a map being built by a
+// load. The node known from a previous load is reused if any, so its own
+// loaded children are kept. A new node is on driveId, if not n's drive.
+// Also returns the kind of change compared to the previous load.
+func (n *fsNode) loadChild(children, prev map[string]*fsNode, infoMap map[string]interface{}, oname, driveId string) (*fsNode, string) {
+	if oname == "" {
+		oname = encodeName(infoMap["Name"].(string))
+	}
+	name, _ := uniqueName(children, oname, infoMap["Type"] == "folder")
+
+	c, ok := prev[infoMap["Drive_Item__"].(string)]
+	if !ok {
+		c = makeNode(infoMap, name, n)
+		if driveId != "" {
+			c.driveId = driveId
+		}
+		children[name] = c
+		return c, changeCreated
+	}
+
+	before := c.version()
+	c.store(infoMap)
+	c.lk.Lock()
+	c.name = name
+	c.parent = n
+	if c.Type == "file" {
+		// info is fresh
+		c.refresh = time.Now()
+	}
+	c.lk.Unlock()
+	children[name] = c
+	if c.version() != before {
+		return c, changeUpdated
+	}
+	return c, ""
+}
+
 func (n *fsNode) loadInternal() {
 	if n.isRoot {
 		n.initRoot()
 		return
 	}
 
-	n.refresh = time.Now()
-
 	switch n.Type {
 	case "folder":
+		n.setRefresh(time.Now())
+
 		// need to grab children
-		res, err := n.fs.c.Rest("Drive/"+url.PathEscape(n.driveId)+"/Item", "GET", oauth2.RestParam{"Parent_Drive_Item__": n.Id, "results_per_page": "1000"})
+		res, err := n.fs.rest("Drive/"+url.PathEscape(n.driveId)+"/Item", "GET", oauth2.RestParam{"Parent_Drive_Item__": n.Id, "results_per_page": "1000"})
 		if err != nil {
 			log.Printf("folder list failed: %s", err)
-			n.err = err
+			n.setErr(err)
+			n.setRefresh(time.Time{}) // retry on next access
 			return
 		}
+		n.setErr(nil)
 
 		// list of drive items
-		list := res.Data.([]interface{})
-		n.children = make(map[string]*fsNode)
+		list := make([]map[string]interface{}, 0, len(res.Data.([]interface{})))
+		for _, info := range res.Data.([]interface{}) {
+			list = append(list, info.(map[string]interface{}))
+		}
+		loaded := n.loaded()
+		prev := n.childrenById()
+		names := n.childNames(prev, list, nil)
+		children := make(map[string]*fsNode)
+		var changes []changeEvent
 
 		log.Printf("found %d children", len(list))
 
 		// for each drive
-		for _, info := range list {
-			n.addChild(info.(map[string]interface{}), "")
+		for _, infoMap := range list {
+			c, op := n.loadChild(children, prev, infoMap, names[infoMap["Drive_Item__"].(string)], "")
+			changes = appendChange(changes, op, c)
+			delete(prev, c.Id)
+		}
+		n.setChildren(children, !loaded || len(changes) > 0 || len(prev) > 0)
+		for _, c := range prev {
+			n.fs.meta.forget(c)
+		}
+		if loaded {
+			n.fs.notifyChanges(n, changes, prev)
+		}
+
+		if n.fs.queue != nil {
+			n.fs.queue.attach(n)
 		}
 	case "file":
-		// nothing
+		if n.Id == "" || time.Since(n.lastRefresh()) < n.ttl() {
+			// pending upload, or info still fresh from parent listing
+			return
+		}
+		n.setRefresh(time.Now())
+
+		res, err := n.fs.rest("Drive/Item/"+url.PathEscape(n.Id), "GET", nil)
+		if err != nil {
+			log.Printf("failed to refresh %s: %s", n.Name(), err)
+			return
+		}
+		n.store(res.Data.(map[string]interface{}))
 	default:
 		log.Printf("unsupported access to node")
-		n.err = webdav.ErrNotImplemented
+		n.setErr(webdav.ErrNotImplemented)
 	}
 }
 
+// newRoot returns the root node of fs, listing drives
+func newRoot(fs *DriveFS) *fsNode {
+	return &fsNode{fs: fs, isRoot: true, Id: "Drive", Type: "folder"}
+}
+
 func (n *fsNode) initRoot() {
 	// special case: list of drives
-	n.Id = "Drive"
-	n.Type = "folder"
+	n.setRefresh(time.Now())
 
-	res, err := n.fs.c.Rest("Drive", "GET", oauth2.RestParam{"results_per_page": "1000"})
+	res, err := n.fs.rest("Drive", "GET", oauth2.RestParam{"results_per_page": "1000"})
 	if err != nil {
 		log.Printf("Failed to get drives list: %s", err)
-		n.err = err
+		n.setErr(err)
+		n.setRefresh(time.Time{}) // retry on next access
 		return
 	}
+	n.setErr(nil)
 
-	// list of drives
-	list := res.Data.([]interface{})
-	n.children = make(map[string]*fsNode)
+	// list of drives, named after the drive rather than its root item
+	var roots []map[string]interface{}
+	var onames []string
+	for _, info := range res.Data.([]interface{}) {
+		infoMap := info.(map[string]interface{})
+		roots = append(roots, infoMap["Root"].(map[string]interface{}))
+		onames = append(onames, encodeName(infoMap["Name"].(string)))
+	}
+	loaded := n.loaded()
+	prev := n.childrenById()
+	names := n.childNames(prev, roots, onames)
+	children := make(map[string]*fsNode)
+	var changes []changeEvent
 
 	// for each drive
-	for _, info := range list {
+	for i, info := range res.Data.([]interface{}) {
 		infoMap := info.(map[string]interface{})
-		node := n.addChild(infoMap["Root"].(map[string]interface{}), infoMap["Name"].(string))
-		if node != nil {
-			node.driveId = infoMap["Drive__"].(string)
-		}
+		node, op := n.loadChild(children, prev, roots[i], names[roots[i]["Drive_Item__"].(string)], infoMap["Drive__"].(string))
+		changes = appendChange(changes, op, node)
+		delete(prev, node.Id)
+	}
+	n.setChildren(children, !loaded || len(changes) > 0 || len(prev) > 0)
+	for _, c := range prev {
+		n.fs.meta.forget(c)
+	}
+	if loaded {
+		n.fs.notifyChanges(n, changes, prev)
 	}
 }
 
+// get returns the node at path below n
 func (n *fsNode) get(path string) (*fsNode, error) {
-	n.load()
+	return n.find(path, false)
+}
+
+// resolve returns the node at path below n, as requested by the client of
+// ctx
+func (n *fsNode) resolve(ctx context.Context, path string) (*fsNode, error) {
+	return n.find(path, foldCase(requestFromContext(ctx)))
+}
+
+// find returns the node at path below n, ignoring case if fold is set and
+// there is no exact match
+func (n *fsNode) find(path string, fold bool) (*fsNode, error) {
+	n.revalidate()
 	if path == "" || path == "/" {
 		return n, nil
 	}
@@ -183,23 +363,27 @@ func (n *fsNode) get(path string) (*fsNode, error) {
 		// ... nope. can't browse inside a file
 		return nil, os.ErrInvalid
 	}
+	n.use()
 	path = strings.TrimLeft(path, "/")
 
 	pos := strings.IndexByte(path, '/')
 	if pos != -1 {
 		// sub
 		k := path[:pos]
-		p, ok := n.children[k]
+		p, ok := n.lookupLoaded(k, fold)
 		if !ok {
 			return nil, os.ErrNotExist
 		}
-		return p.get(path[pos+1:])
+		return p.find(path[pos+1:], fold)
 	}
 
-	p, ok := n.children[path]
+	p, ok := n.lookupLoaded(path, fold)
 	if !ok {
 		return nil, os.ErrNotExist
 	}
+	if p.Type == "file" {
+		p.revalidate()
+	}
 	return p, nil
 }
 
@@ -209,45 +393,65 @@ func (n *fsNode) IsDir() bool {
 
 func (n *fsNode) moveToTrash() error {
 	// let's proceed
-	if n.parent == nil || n.parent.isRoot {
+	parent := n.getParent()
+	if parent == nil || parent.isRoot {
 		// invalid
 		return os.ErrInvalid
 	}
 
-	_, err := n.fs.c.Rest("Drive/Item/"+url.PathEscape(n.Id), "DELETE", oauth2.RestParam{})
+	if item := n.pendingItem(); item != nil && n.Id == "" {
+		// not uploaded yet
+		n.fs.queue.cancel(item)
+		parent.removeChild(n)
+		return nil
+	}
+
+	_, err := n.fs.rest("Drive/Item/"+url.PathEscape(n.Id), "DELETE", oauth2.RestParam{})
 	if err != nil {
 		return err
 	}
 
 	// remove from parent
-	delete(n.parent.children, n.name)
+	parent.removeChild(n)
+	n.fs.meta.forget(n)
 	return nil
 }
 
 func (n *fsNode) Mode() os.FileMode {
 	// TODO check rights, do not return write right if only read access
-	switch n.Type {
-	case "file":
-		return 0755
-	case "folder":
+	if n.Type == "folder" {
 		return os.ModeDir | 0755
-	case "special":
-		return 0
-	default:
-		return 0
 	}
+	if n.contentKind() != contentNormal {
+		// cannot be downloaded or written
+		return 0444
+	}
+	return 0755
 }
 
 func (n *fsNode) ModTime() time.Time {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
 	return n.LastModified
 }
 
 func (n *fsNode) Name() string {
+	n.lk.RLock()
+	defer n.lk.RUnlock()
 	return n.name
 }
 
 func (n *fsNode) Size() int64 {
-	return n.size
+	switch n.contentKind() {
+	case contentStub:
+		return int64(len(n.stub()))
+	case contentEmpty:
+		if n.Type != "folder" {
+			return 0
+		}
+	}
+	_, size := n.content()
+	return size
 }
 
 func (s *fsNode) Sys() interface{} {
@@ -255,13 +459,19 @@ func (s *fsNode) Sys() interface{} {
 }
 
 func (s *fsNode) ETag(ctx context.Context) (string, error) {
-	if s.Blob == "" {
+	blob, _ := s.content()
+	if blob == "" {
 		return "", webdav.ErrNotImplemented
 	}
-	return "\"" + s.Blob + "\"", nil
+	return "\"" + blob + "\"", nil
 }
 
 func (s *fsNode) ContentType(ctx context.Context) (string, error) {
+	if s.contentKind() == contentStub {
+		return s.stubMime(), nil
+	}
+	s.lk.RLock()
+	defer s.lk.RUnlock()
 	if s.mime == "" {
 		return "", webdav.ErrNotImplemented
 	}
@@ -274,7 +484,7 @@ func (n *fsNode) Mkdir(ctx context.Context, name string, perm os.FileMode) error
 
 	pos := strings.IndexByte(name, '/')
 	if pos != -1 {
-		p, err := n.get(name[:pos])
+		p, err := n.resolve(ctx, name[:pos])
 		if err != nil {
 			return err
 		}
@@ -286,7 +496,7 @@ func (n *fsNode) Mkdir(ctx context.Context, name string, perm os.FileMode) error
 	}
 
 	// create dir
-	res, err := n.fs.c.Rest("Drive/Item", "POST", oauth2.RestParam{"Name": name, "Parent_Drive_Item__": n.Id})
+	res, err := n.fs.rest("Drive/Item", "POST", oauth2.RestParam{"Name": decodeName(name), "Parent_Drive_Item__": n.Id})
 	if err != nil {
 		// failed to create dir
 		return err
@@ -303,33 +513,38 @@ func (n *fsNode) OpenFile(ctx context.Context, name string, flag int, perm os.Fi
 		name = strings.TrimLeft(name, "/")
 		pos := strings.IndexByte(name, '/')
 		if pos != -1 {
-			p, err := n.get(name[:pos])
+			p, err := n.resolve(ctx, name[:pos])
 			if err != nil {
 				return nil, err
 			}
 			return p.OpenFile(ctx, name[pos+1:], flag, perm)
 		}
 
-		// check flags
-		if flag&os.O_APPEND != 0 {
-			log.Printf("no append")
-			// cannot append with webdav
-			return nil, webdav.ErrNotImplemented
-		}
-
-		// TODO handle file creation
-		p, err := n.get(name)
+		p, err := n.resolve(ctx, name)
 		if err == nil {
+			if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+				return nil, os.ErrExist
+			}
 			return p.OpenFile(ctx, "", flag, perm)
 		}
 
 		if flag&os.O_CREATE != 0 {
 			// ok, let the user create a file
-			res, err := oauth2.NewUpload(n.fs.c, "Drive/Item/"+url.PathEscape(n.Id)+":upload", oauth2.RestParam{"filename": name})
-			if err != nil {
+			if n.isRoot {
+				return nil, os.ErrInvalid
+			}
+			f := &fsNodeFile{parent: n, name: name, flag: flag, perm: perm, expect: expectedSize(ctx), req: ctx, mime: uploadMime(ctx, name)}
+			f.upLimit, f.downLimit = requestLimiters(ctx)
+			if err := f.truncate(); err != nil {
 				return nil, err
 			}
-			return &fsNodeFile{parent: n, upload: res, flag: flag, perm: perm}, nil
+			if r := requestFromContext(ctx); r != nil && r.Method == "LOCK" {
+				// locking a path creates it, only upload if data is
+				// written
+				f.dirty = false
+			}
+			f.held = n.hold()
+			return f, nil
 		}
 		return nil, err
 	}
@@ -338,23 +553,41 @@ func (n *fsNode) OpenFile(ctx context.Context, name string, flag int, perm os.Fi
 	case "folder":
 		log.Printf("return iterator")
 		n.reloadData()
-		c := make([]os.FileInfo, len(n.children))
-		pos := 0
-		for _, sub := range n.children {
-			c[pos] = sub
-			pos++
+		list := n.childList()
+		c := make([]os.FileInfo, len(list))
+		for i, sub := range list {
+			c[i] = sub
 		}
-		return &fsNodeFolderIterator{self: n, children: c}, nil
-	case "file", "special":
-		return &fsNodeFile{self: n, flag: flag, perm: perm}, nil
+		return &fsNodeFolderIterator{self: n, children: c, held: n.hold()}, nil
 	default:
-		return nil, os.ErrInvalid
+		f := &fsNodeFile{self: n, flag: flag, perm: perm, expect: expectedSize(ctx), req: ctx, mime: uploadMime(ctx, n.Name())}
+		f.upLimit, f.downLimit = requestLimiters(ctx)
+		if f.writable() && n.contentKind() != contentNormal {
+			// special items are read-only
+			return nil, os.ErrPermission
+		}
+		if flag&os.O_TRUNC != 0 && f.writable() {
+			if err := f.truncate(); err != nil {
+				return nil, err
+			}
+		}
+		f.held = n.hold()
+		return f, nil
 	}
 }
 
 func (n *fsNode) overwrite() (*oauth2.Upload, error) {
-	return oauth2.NewUpload(n.fs.c, "Drive/Item/"+url.PathEscape(n.Id)+":overwrite", nil)
+	return n.fs.newUpload("Drive/Item/"+url.PathEscape(n.Id)+":overwrite", nil)
+}
 
+// expectedSize returns the size of the data about to be written if the
+// client provided it, or -1
+func expectedSize(ctx context.Context) int64 {
+	r := requestFromContext(ctx)
+	if r == nil || r.Method != "PUT" {
+		return -1
+	}
+	return r.ContentLength
 }
 
 func (n *fsNode) Rename(ctx context.Context, oldName, newName string) error {
@@ -362,14 +595,14 @@ func (n *fsNode) Rename(ctx context.Context, oldName, newName string) error {
 		oldName = strings.TrimLeft(oldName, "/")
 		pos := strings.IndexByte(oldName, '/')
 		if pos != -1 {
-			p, err := n.get(oldName[:pos])
+			p, err := n.resolve(ctx, oldName[:pos])
 			if err != nil {
 				return err
 			}
 			return p.Rename(ctx, oldName[pos+1:], newName)
 		}
 
-		p, err := n.get(oldName)
+		p, err := n.resolve(ctx, oldName)
 		if err != nil {
 			return err
 		}
@@ -377,38 +610,42 @@ func (n *fsNode) Rename(ctx context.Context, oldName, newName string) error {
 	}
 
 	// get target dir
-	tgt, err := n.fs.root.get(path.Dir(newName))
+	tgt, err := n.fs.root.resolve(ctx, path.Dir(newName))
 	if err != nil {
 		return err
 	}
 	newName = path.Base(newName)
-	if tgt == n.parent {
+	if item := n.pendingItem(); item != nil && n.Id == "" {
+		// not uploaded yet, update queued upload
+		if tgt.isRoot {
+			return os.ErrInvalid
+		}
+		if err := n.fs.queue.move(item, tgt, newName); err != nil {
+			return err
+		}
+		n.moveTo(tgt, newName)
+		return nil
+	}
+	if tgt == n.getParent() {
 		// rename only
-		if newName == n.name {
+		if newName == n.Name() {
 			// nothing?
 			return nil
 		}
-		res, err := n.fs.c.Rest("Drive/Item/"+url.PathEscape(n.Id), "PATCH", oauth2.RestParam{"Name": newName})
+		res, err := n.fs.rest("Drive/Item/"+url.PathEscape(n.Id), "PATCH", oauth2.RestParam{"Name": decodeName(newName)})
 		if err != nil {
 			return err
 		}
-		// update (ugly, FIXME)
-		delete(n.parent.children, n.name)
-		n.name = res.Data.(map[string]interface{})["Name"].(string)
-		n.parent.children[n.name] = n
+		n.moveTo(tgt, encodeName(res.Data.(map[string]interface{})["Name"].(string)))
 		return nil
 	}
 
 	// use move API
-	res, err := n.fs.c.Rest("Drive/Item/"+url.PathEscape(n.Id)+":moveTo", "POST", oauth2.RestParam{"target": tgt.Id, "rename": newName})
+	res, err := n.fs.rest("Drive/Item/"+url.PathEscape(n.Id)+":moveTo", "POST", oauth2.RestParam{"target": tgt.Id, "rename": decodeName(newName)})
 	if err != nil {
 		return err
 	}
 
-	// update (ugly, FIXME)
-	delete(n.parent.children, n.name)
-	n.name = res.Data.(map[string]interface{})["Name"].(string)
-	n.parent = tgt
-	n.parent.children[n.name] = n
+	n.moveTo(tgt, encodeName(res.Data.(map[string]interface{})["Name"].(string)))
 	return nil
 }
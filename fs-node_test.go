@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestStoreNull(t *testing.T) {
+	fs := testFS(newFakeAPI())
+	parent := &fsNode{fs: fs, Id: "p", Type: "folder", driveId: "drv"}
+
+	// as decoded from JSON nulls
+	n := makeNode(map[string]interface{}{
+		"Drive_Item__": "f",
+		"Type":         "file",
+		"Size":         "0",
+		"Blob__":       nil,
+		"Mime":         nil,
+		"Download_Url": nil,
+	}, "f.txt", parent)
+	if n.downloadable() || n.blob() != "" {
+		t.Errorf("item without content is downloadable")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/oauth2"
+)
+
+// When the API cannot be reached, the filesystem goes offline: API calls
+// fail at once, metadata known so far is served as is, content is served
+// from the block cache, and changes are refused. A probe checks for
+// connectivity in the background and brings the filesystem back online.
+
+var errOffline = errors.New("drive is offline")
+
+// offlineProbeInterval is the delay between connectivity checks while
+// offline
+const offlineProbeInterval = 15 * time.Second
+
+// rest performs an API call, tracking connectivity
+func (fs *DriveFS) rest(req, method string, param oauth2.RestParam) (*oauth2.RestResponse, error) {
+	if fs.isOffline() {
+		return nil, errOffline
+	}
+	res, err := fs.c.Rest(req, method, param)
+	if err = fs.checkNet(err); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// newUpload prepares an upload. Errors of the upload's methods must be
+// passed to checkNet, as they make requests to the API and storage.
+func (fs *DriveFS) newUpload(req string, param oauth2.RestParam) (*oauth2.Upload, error) {
+	if fs.isOffline() {
+		return nil, errOffline
+	}
+	up, err := oauth2.NewUpload(fs.c, req, param)
+	return up, fs.checkNet(err)
+}
+
+// checkNet switches to offline mode if err means the server could not be
+// reached, and returns errOffline then
+func (fs *DriveFS) checkNet(err error) error {
+	if err != nil && isNetworkError(err) {
+		fs.goOffline(err)
+		return errOffline
+	}
+	return err
+}
+
+// isNetworkError returns true if err means the server could not be reached,
+// as opposed to an error returned by the server
+func isNetworkError(err error) bool {
+	// url.Error is itself a net.Error, look at what it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (fs *DriveFS) isOffline() bool {
+	fs.offlineL.Lock()
+	defer fs.offlineL.Unlock()
+	return !fs.offlineSince.IsZero()
+}
+
+// goOffline switches to offline mode after err, and starts probing for
+// connectivity
+func (fs *DriveFS) goOffline(err error) {
+	fs.offlineL.Lock()
+	defer fs.offlineL.Unlock()
+
+	fs.offlineErr = err
+	if !fs.offlineSince.IsZero() {
+		return
+	}
+	fs.offlineSince = time.Now()
+	log.Printf("[offline] API unreachable, switching to offline mode: %s", err)
+	go fs.probe()
+}
+
+// probe waits until the API is reachable again, then switches back online
+// and revalidates the tree
+func (fs *DriveFS) probe() {
+	for {
+		time.Sleep(offlineProbeInterval)
+		_, err := fs.c.Rest("Drive", "GET", oauth2.RestParam{"results_per_page": "1"})
+		if err != nil && isNetworkError(err) {
+			fs.offlineL.Lock()
+			fs.offlineErr = err
+			fs.offlineL.Unlock()
+			continue
+		}
+		break
+	}
+
+	fs.offlineL.Lock()
+	log.Printf("[offline] API reachable again after %s, back online", time.Since(fs.offlineSince).Truncate(time.Second))
+	fs.offlineSince = time.Time{}
+	fs.offlineErr = nil
+	fs.offlineL.Unlock()
+
+	fs.poll()
+}
+
+// isWrite returns true if r would modify the filesystem
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case "PUT", "DELETE", "MKCOL", "MOVE", "COPY", "PROPPATCH":
+		return true
+	}
+	return false
+}
+
+// serveOffline refuses writes while offline. Uploads are still accepted in
+// write-back mode, as they are queued anyway. Returns false if the request
+// can proceed.
+func (fs *DriveFS) serveOffline(w http.ResponseWriter, r *http.Request) bool {
+	if !isWrite(r) || !fs.isOffline() {
+		return false
+	}
+	if r.Method == "PUT" && fs.queue != nil {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(offlineProbeInterval/time.Second)))
+	http.Error(w, "The drive is offline and read-only until the connection comes back", http.StatusServiceUnavailable)
+	return true
+}
+
+// connStatus returns a human readable connectivity status
+func (fs *DriveFS) connStatus() string {
+	fs.offlineL.Lock()
+	defer fs.offlineL.Unlock()
+	if fs.offlineSince.IsZero() {
+		return "online"
+	}
+	return fmt.Sprintf("offline since %s: %s", fs.offlineSince.Format(time.RFC3339), fs.offlineErr)
+}
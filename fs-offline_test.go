@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestIsNetworkError(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{dial, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: dial}, true},
+		{fmt.Errorf("listing: %w", &url.Error{Op: "Get", URL: "https://example.com", Err: dial}), true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: errors.New("token expired")}, false},
+		{errors.New("[rest] error from server: not found"), false},
+	}
+	for _, test := range tests {
+		if got := isNetworkError(test.err); got != test.want {
+			t.Errorf("isNetworkError(%s) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// unreachable is a transport failing as if the network was down
+type unreachable struct{}
+
+func (unreachable) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+}
+
+func TestUploadOffline(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fs := testFS(newFakeAPI())
+	fs.c.Client.Transport = unreachable{}
+
+	up, err := fs.newUpload("Drive/Item/x:upload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.Write([]byte("data"))
+	_, err = up.Complete()
+	if err = fs.checkNet(err); err != errOffline || !fs.isOffline() {
+		t.Fatalf("upload to unreachable server did not switch offline: %v", err)
+	}
+	if _, err := fs.newUpload("Drive/Item/x:upload", nil); err != errOffline {
+		t.Errorf("upload started while offline: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/cfgpath"
+)
+
+// pinManager keeps pinned paths fully downloaded in the block cache. Blocks
+// of pinned files are pinned in the cache so they are never evicted, and
+// pinned paths are walked regularly to follow remote changes.
+type pinManager struct {
+	fs   *DriveFS
+	file string
+	lk   sync.Mutex
+	wake chan struct{}
+
+	Pins  []*pinEntry           `json:"pins"`
+	Blobs map[string]pinnedBlob `json:"blobs"` // blobs with pinned blocks
+}
+
+type pinEntry struct {
+	Path     string    `json:"path"`
+	LastSync time.Time `json:"last_sync"`
+	Files    int       `json:"files"`
+	Size     int64     `json:"size"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type pinnedBlob struct {
+	Size  int64 `json:"size"`
+	Block int64 `json:"block"` // block size used when pinning
+}
+
+func newPinManager(fs *DriveFS) *pinManager {
+	p := &pinManager{
+		fs:    fs,
+		file:  filepath.Join(cfgpath.GetCacheDir(), "pins.json"),
+		wake:  make(chan struct{}, 1),
+		Blobs: make(map[string]pinnedBlob),
+	}
+
+	data, err := ioutil.ReadFile(p.file)
+	if err == nil {
+		err = json.Unmarshal(data, p)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[pin] failed to load %s: %s", p.file, err)
+	}
+	if p.Blobs == nil {
+		p.Blobs = make(map[string]pinnedBlob)
+	}
+
+	go p.run()
+	go p.follow()
+	return p
+}
+
+// follow triggers a sync when a remote change affects a pinned path
+func (p *pinManager) follow() {
+	ch, _ := p.fs.changes.subscribe()
+	for ev := range ch {
+		if p.covers(ev.Path) {
+			p.signal()
+		}
+	}
+}
+
+// protects returns true if name is a pinned path, or is above or below one
+func (p *pinManager) protects(name string) bool {
+	if p.covers(name) {
+		return true
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, e := range p.Pins {
+		if strings.HasPrefix(e.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if name is a pinned path or below one
+func (p *pinManager) covers(name string) bool {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, e := range p.Pins {
+		if name == e.Path || strings.HasPrefix(name, strings.TrimSuffix(e.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes state to disk. Must be called with lock held.
+func (p *pinManager) save() {
+	data, err := json.Marshal(p)
+	if err == nil {
+		err = ioutil.WriteFile(p.file+".new", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(p.file+".new", p.file)
+	}
+	if err != nil {
+		log.Printf("[pin] failed to save state: %s", err)
+	}
+}
+
+func (p *pinManager) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// add pins a path, which will be downloaded in the background
+func (p *pinManager) add(name string) error {
+	name = path.Clean("/" + name)
+	if _, err := p.fs.root.get(name); err != nil {
+		return err
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for _, e := range p.Pins {
+		if e.Path == name {
+			return nil
+		}
+	}
+	p.Pins = append(p.Pins, &pinEntry{Path: name})
+	p.save()
+	p.signal()
+	return nil
+}
+
+// remove unpins a path. Its data stays in the cache, subject to eviction.
+func (p *pinManager) remove(name string) error {
+	name = path.Clean("/" + name)
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for i, e := range p.Pins {
+		if e.Path == name {
+			p.Pins = append(p.Pins[:i], p.Pins[i+1:]...)
+			p.save()
+			p.signal()
+			return nil
+		}
+	}
+	return os.ErrNotExist
+}
+
+func (p *pinManager) run() {
+	for {
+		p.sync()
+
+		t := time.NewTimer(time.Duration(config.PinInterval) * time.Second)
+		select {
+		case <-p.wake:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// sync downloads and pins data of all pinned paths, and releases blobs which
+// are not pinned anymore
+func (p *pinManager) sync() {
+	p.lk.Lock()
+	list := make([]*pinEntry, len(p.Pins))
+	copy(list, p.Pins)
+	p.lk.Unlock()
+
+	wanted := make(map[string]pinnedBlob)
+	failed := false
+	for _, e := range list {
+		files, size, err := p.syncPath(e.Path, wanted)
+
+		p.lk.Lock()
+		e.LastSync = time.Now()
+		e.Files, e.Size = files, size
+		e.Error = ""
+		if err != nil {
+			e.Error = err.Error()
+			failed = true
+		}
+		p.lk.Unlock()
+
+		if err != nil {
+			log.Printf("[pin] sync of %s failed: %s", e.Path, err)
+		}
+	}
+
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	for blob, b := range p.Blobs {
+		if _, ok := wanted[blob]; ok {
+			continue
+		}
+		if failed {
+			// part of the tree may not have been seen, keep what we have
+			continue
+		}
+		for off := int64(0); off < b.Size; off += b.Block {
+			p.fs.cache.Unpin(blob, off)
+		}
+		delete(p.Blobs, blob)
+	}
+	p.save()
+}
+
+// syncPath walks a pinned path, downloading and pinning all files
+func (p *pinManager) syncPath(name string, wanted map[string]pinnedBlob) (int, int64, error) {
+	n, err := p.fs.root.get(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var files int
+	var size int64
+	var firstErr error
+
+	var walk func(n *fsNode)
+	walk = func(n *fsNode) {
+		if n.Type == "folder" {
+			n.reloadData()
+			if err := n.loadErr(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			for _, c := range n.childList() {
+				walk(c)
+			}
+			return
+		}
+		blob, l := n.content()
+		if n.pendingItem() != nil || blob == "" || n.contentKind() != contentNormal {
+			// nothing to download
+			return
+		}
+		files++
+		size += l
+		if err := p.pinFile(n, blob, l, wanted); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", n.Name(), err)
+		}
+	}
+	walk(n)
+	return files, size, firstErr
+}
+
+// pinFile ensures all blocks of n's blob are in the cache and pinned
+func (p *pinManager) pinFile(n *fsNode, blob string, size int64, wanted map[string]pinnedBlob) error {
+	p.lk.Lock()
+	b, ok := p.Blobs[blob]
+	if !ok {
+		b = pinnedBlob{Size: size, Block: config.ReadAheadBlock}
+		p.Blobs[blob] = b
+	}
+	p.lk.Unlock()
+	wanted[blob] = b
+
+	c := p.fs.cache
+	for off := int64(0); off < b.Size; off += b.Block {
+		if c.Pin(blob, off) {
+			// already cached
+			continue
+		}
+		l := b.Block
+		if off+l > b.Size {
+			l = b.Size - off
+		}
+		if _, err := n.readBlock(context.Background(), blob, off, l); err != nil {
+			return err
+		}
+		if !c.Pin(blob, off) {
+			return fmt.Errorf("failed to store block at %d in cache", off)
+		}
+	}
+	return nil
+}
+
+// status writes a human readable list of pinned paths
+func (p *pinManager) status(w io.Writer) {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+
+	list := make([]*pinEntry, len(p.Pins))
+	copy(list, p.Pins)
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+
+	fmt.Fprintf(w, "%d pinned paths, %d bytes pinned in cache\n", len(list), p.fs.cache.PinnedSize())
+	for _, e := range list {
+		state := "waiting for sync"
+		if !e.LastSync.IsZero() {
+			state = "synced " + e.LastSync.Format(time.RFC3339)
+		}
+		line := []string{e.Path, fmt.Sprintf("%d files", e.Files), fmt.Sprintf("%d bytes", e.Size), state}
+		if e.Error != "" {
+			line = append(line, "error: "+e.Error)
+		}
+		fmt.Fprintf(w, "%s\n", strings.Join(line, "\t"))
+	}
+}
+
+// servePin handles /_pin?add=path and /_pin?remove=path as POST requests, and
+// shows the list of pinned paths
+func (fs *DriveFS) servePin(w http.ResponseWriter, r *http.Request) {
+	if fs.pins == nil {
+		fmt.Fprintf(w, "pinning requires the cache to be enabled\n")
+		return
+	}
+
+	if (r.FormValue("add") != "" || r.FormValue("remove") != "") && !controlAllowed(w, r) {
+		return
+	}
+	if v := r.FormValue("add"); v != "" {
+		if err := fs.pins.add(v); err != nil {
+			http.Error(w, fmt.Sprintf("failed to pin %s: %s", v, err), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("remove"); v != "" {
+		if err := fs.pins.remove(v); err != nil {
+			http.Error(w, fmt.Sprintf("failed to unpin %s: %s", v, err), http.StatusBadRequest)
+			return
+		}
+	}
+	fs.pins.status(w)
+}
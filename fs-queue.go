@@ -0,0 +1,635 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/cfgpath"
+	"github.com/AtOnline/drive-webdav/oauth2"
+)
+
+// uploadQueue implements write-back: data is first spooled to disk, then
+// uploaded in the background with retries. Spooled data and its metadata are
+// kept until the upload succeeds, so pending uploads survive restarts.
+type uploadQueue struct {
+	fs    *DriveFS
+	dir   string
+	items map[string]*queueItem
+	lk    sync.Mutex
+	wake  chan struct{}
+}
+
+type queueItem struct {
+	Id        string    `json:"id"`
+	Parent    string    `json:"parent,omitempty"` // parent folder, for new files
+	Item      string    `json:"item,omitempty"`   // overwritten item, if any
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash,omitempty"` // sha256 of data
+	Mime      string    `json:"mime,omitempty"`
+	Client    string    `json:"client,omitempty"` // bandwidth limits of the client which wrote the data
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	Failures  int       `json:"failures,omitempty"` // attempts which failed for other reasons than the network
+	LastError string    `json:"last_error,omitempty"`
+	NextTry   time.Time `json:"next_try"`         // or removal, for failed items
+	Failed    bool      `json:"failed,omitempty"` // given up, see fail()
+
+	node      *fsNode // node showing this item in the tree, if any
+	busy      bool    // upload in progress
+	cancelled bool
+	moved     bool    // renamed while busy
+	origin    *fsNode // folder of node when the upload started
+	sentName  string  // name the upload was sent with
+}
+
+const (
+	// failed attempts, network errors excepted, before an upload is given up
+	queueMaxFailures = 10
+	// failed attempts before an upload refused by the server is given up
+	queueMaxRefused = 3
+	// how long data of failed uploads is kept
+	queueKeepFailed = 7 * 24 * time.Hour
+	// attempts to rename a file uploaded while being renamed
+	queueMoveAttempts = 3
+)
+
+func newUploadQueue(fs *DriveFS) (*uploadQueue, error) {
+	q := &uploadQueue{
+		fs:    fs,
+		dir:   filepath.Join(cfgpath.GetCacheDir(), "spool"),
+		items: make(map[string]*queueItem),
+		wake:  make(chan struct{}, 1),
+	}
+	if err := cfgpath.EnsureDir(q.dir); err != nil {
+		return nil, err
+	}
+
+	// reload items left from a previous run
+	list, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			log.Printf("[queue] failed to read %s: %s", p, err)
+			continue
+		}
+		item := &queueItem{}
+		if err := json.Unmarshal(data, item); err != nil {
+			log.Printf("[queue] failed to parse %s: %s", p, err)
+			continue
+		}
+		q.items[item.Id] = item
+	}
+	if len(q.items) > 0 {
+		log.Printf("[queue] resuming %d pending uploads", len(q.items))
+	}
+
+	// spool files which never made it to the queue
+	list, _ = filepath.Glob(filepath.Join(q.dir, "*.data"))
+	for _, p := range list {
+		id := strings.TrimSuffix(filepath.Base(p), ".data")
+		if _, ok := q.items[id]; !ok {
+			os.Remove(p)
+		}
+	}
+
+	go q.run()
+	return q, nil
+}
+
+func (q *uploadQueue) dataPath(id string) string {
+	return filepath.Join(q.dir, id+".data")
+}
+
+func (q *uploadQueue) metaPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// spool creates a new file to receive data to be uploaded
+func (q *uploadQueue) spool() (*os.File, string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	id := hex.EncodeToString(buf)
+	f, err := os.OpenFile(q.dataPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, id, nil
+}
+
+// save writes item's metadata to disk. Must be called with lock held.
+func (q *uploadQueue) save(item *queueItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	p := q.metaPath(item.Id)
+	f, err := os.OpenFile(p+".new", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(p+".new", p)
+}
+
+func (q *uploadQueue) remove(item *queueItem) {
+	delete(q.items, item.Id)
+	os.Remove(q.metaPath(item.Id))
+	if err := os.Remove(q.dataPath(item.Id)); err != nil {
+		log.Printf("[queue] failed to remove spool file: %s", err)
+	}
+}
+
+// commit queues spooled data f for upload, either as a new file named name
+// in parent, or as new contents for node. The upload is limited as client's
+// transfers, see requestClient. The file is closed. Returns the node
+// representing the pending upload.
+func (q *uploadQueue) commit(f *os.File, id string, parent, node *fsNode, name, hash, mime, client string) (*fsNode, error) {
+	st, err := f.Stat()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if node != nil && node.Id == "" && node.pendingItem() == nil {
+		// placeholder of an upload completed since, write to the new item
+		name, parent = node.Name(), node.getParent()
+		node = nil
+		if parent == nil {
+			os.Remove(f.Name())
+			return nil, os.ErrNotExist
+		}
+		if c, ok := parent.child(name); ok && (c.Id != "" || c.pendingItem() != nil) {
+			node = c
+		}
+	}
+
+	if node == nil {
+		// before taking the lock, as loading attaches pending uploads
+		parent.load()
+	}
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	item := &queueItem{
+		Id:      id,
+		Name:    name,
+		Size:    st.Size(),
+		Hash:    hash,
+		Mime:    mime,
+		Client:  client,
+		Created: time.Now(),
+		NextTry: time.Now(),
+	}
+
+	var prev *queueItem
+	if node != nil {
+		prev = node.pendingItem()
+	}
+	if prev != nil {
+		// data not uploaded yet is being replaced, keep target of previous item
+		item.Parent, item.Item = prev.Parent, prev.Item
+		if prev.busy {
+			prev.cancelled = prev.Item == ""
+		} else {
+			q.remove(prev)
+		}
+	} else if node != nil {
+		item.Item = node.Id
+		item.Name = node.Name()
+	} else {
+		item.Parent = parent.Id
+	}
+
+	if err := q.save(item); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if node == nil {
+		// placeholder until the upload completes
+		node = &fsNode{
+			fs:      parent.fs,
+			name:    name,
+			Type:    "file",
+			parent:  parent,
+			driveId: parent.driveId,
+		}
+		parent.putChild(node)
+	}
+	node.lk.Lock()
+	node.size = item.Size
+	node.LastModified = item.Created
+	if item.Mime != "" {
+		node.mime = item.Mime
+	}
+	node.pending = item
+	node.lk.Unlock()
+	item.node = node
+	q.items[id] = item
+
+	log.Printf("[queue] queued %s (%d bytes)", name, item.Size)
+	q.signal()
+	return node, nil
+}
+
+func (q *uploadQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// attach adds pending uploads to folder n, which has just been loaded
+func (q *uploadQueue) attach(n *fsNode) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	for _, item := range q.items {
+		if item.cancelled || item.Failed {
+			continue
+		}
+		if item.Parent == n.Id {
+			if _, found := n.child(item.Name); found {
+				continue
+			}
+			node := &fsNode{
+				fs:           n.fs,
+				name:         item.Name,
+				Type:         "file",
+				size:         item.Size,
+				mime:         item.Mime,
+				LastModified: item.Created,
+				parent:       n,
+				driveId:      n.driveId,
+				pending:      item,
+			}
+			n.putChild(node)
+			item.node = node
+			continue
+		}
+		if item.Item == "" {
+			continue
+		}
+		for _, c := range n.childList() {
+			if c.Id == item.Item {
+				c.lk.Lock()
+				c.size = item.Size
+				c.LastModified = item.Created
+				c.pending = item
+				c.lk.Unlock()
+				item.node = c
+				break
+			}
+		}
+	}
+}
+
+// hasPending returns true if folder n contains pending uploads
+func (q *uploadQueue) hasPending(n *fsNode) bool {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	for _, item := range q.items {
+		if item.Failed {
+			continue
+		}
+		if item.Parent == n.Id || (item.node != nil && item.node.getParent() == n) {
+			return true
+		}
+	}
+	return false
+}
+
+// cancel drops a pending new file
+func (q *uploadQueue) cancel(item *queueItem) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	item.cancelled = true
+	if !item.busy {
+		q.remove(item)
+	}
+}
+
+// move updates a pending new file after a rename
+func (q *uploadQueue) move(item *queueItem, parent *fsNode, name string) error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	item.Parent = parent.Id
+	item.Name = name
+	if item.busy {
+		item.moved = true
+	}
+	return q.save(item)
+}
+
+// next returns the next item due for upload, or how long to wait. Failed
+// items are removed when due.
+func (q *uploadQueue) next() (*queueItem, time.Duration) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	var res *queueItem
+	for _, item := range q.items {
+		if res == nil || item.NextTry.Before(res.NextTry) {
+			res = item
+		}
+	}
+	if res == nil {
+		return nil, time.Hour
+	}
+	if d := time.Until(res.NextTry); d > 0 {
+		return nil, d
+	}
+	if res.Failed {
+		log.Printf("[queue] dropping failed upload of %s", res.Name)
+		q.remove(res)
+		return nil, 0
+	}
+	res.busy = true
+	return res, 0
+}
+
+func (q *uploadQueue) run() {
+	for {
+		if q.fs.isOffline() {
+			// uploads resume once back online
+			time.Sleep(offlineProbeInterval)
+			continue
+		}
+		item, wait := q.next()
+		if item == nil {
+			t := time.NewTimer(wait)
+			select {
+			case <-q.wake:
+			case <-t.C:
+			}
+			t.Stop()
+			continue
+		}
+
+		final, err := q.upload(item)
+		q.done(item, final, err)
+	}
+}
+
+func (q *uploadQueue) upload(item *queueItem) (*oauth2.RestResponse, error) {
+	q.lk.Lock()
+	var req string
+	var param oauth2.RestParam
+	if item.Item != "" {
+		if node := item.node; node != nil && item.Hash != "" && node.fs.blobHash(node.blob()) == item.Hash {
+			// same content as what is already there, just refresh item info
+			q.lk.Unlock()
+			log.Printf("[queue] content of %s unchanged, skipping upload", item.Name)
+			return q.fs.rest("Drive/Item/"+url.PathEscape(item.Item), "GET", nil)
+		}
+		req = "Drive/Item/" + url.PathEscape(item.Item) + ":overwrite"
+	} else {
+		req = "Drive/Item/" + url.PathEscape(item.Parent) + ":upload"
+		param = oauth2.RestParam{"filename": decodeName(item.Name)}
+	}
+	item.sentName, item.origin = item.Name, nil
+	if item.node != nil {
+		item.origin = item.node.getParent()
+	}
+	size, mime, client := item.Size, item.Mime, item.Client
+	q.lk.Unlock()
+
+	f, err := os.Open(q.dataPath(item.Id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	up, err := q.fs.newUpload(req, param)
+	if err != nil {
+		return nil, err
+	}
+	if err := up.SetSize(size); err != nil {
+		return nil, q.fs.checkNet(err)
+	}
+	up.ContentType = mime
+	up.Limiters, _ = clientLimiters(client)
+	if _, err := io.Copy(up, f); err != nil {
+		abortUpload(up)
+		return nil, q.fs.checkNet(err)
+	}
+	final, err := up.Complete()
+	err = q.fs.checkNet(err)
+	if err != nil {
+		abortUpload(up)
+	}
+	if err == nil {
+		q.lk.Lock()
+		item.Mime = up.ContentType
+		q.lk.Unlock()
+	}
+	return final, err
+}
+
+// done records the outcome of the upload of item. The queue state and the
+// tree are updated under lock, requests needed to finish are made after.
+func (q *uploadQueue) done(item *queueItem, final *oauth2.RestResponse, err error) {
+	q.lk.Lock()
+	item.busy = false
+
+	if err != nil {
+		defer q.lk.Unlock()
+		if item.cancelled {
+			q.remove(item)
+			return
+		}
+		item.Attempts++
+		item.LastError = err.Error()
+		var refused *oauth2.ServerError
+		if err != errOffline && !isNetworkError(err) {
+			item.Failures++
+			if item.Failures >= queueMaxFailures || (errors.As(err, &refused) && item.Failures >= queueMaxRefused) {
+				q.fail(item)
+				return
+			}
+		}
+		// exponential backoff, up to 10 minutes
+		wait := 10 * time.Minute
+		if item.Attempts < 8 {
+			wait = time.Duration(5<<uint(item.Attempts-1)) * time.Second
+		}
+		item.NextTry = time.Now().Add(wait)
+		log.Printf("[queue] upload of %s failed (attempt %d, retry in %s): %s", item.Name, item.Attempts, wait, err)
+		if err := q.save(item); err != nil {
+			log.Printf("[queue] failed to save state: %s", err)
+		}
+		return
+	}
+
+	log.Printf("[queue] uploaded %s (%d bytes)", item.Name, item.Size)
+	q.remove(item)
+
+	info := final.Data.(map[string]interface{})
+	if blob, ok := info["Blob__"].(string); ok {
+		q.fs.setBlobHash(blob, item.Hash)
+	}
+	node := q.finish(item, info)
+	cancelled, moved := item.cancelled, item.moved
+	parent, name := item.Parent, item.Name
+	origin, sentName := item.origin, item.sentName
+	q.lk.Unlock()
+
+	id, _ := info["Drive_Item__"].(string)
+	switch {
+	case cancelled:
+		// deleted while uploading
+		if _, err := q.fs.rest("Drive/Item/"+url.PathEscape(id), "DELETE", oauth2.RestParam{}); err != nil {
+			log.Printf("[queue] failed to delete %s: %s", name, err)
+		}
+	case moved:
+		// renamed while being uploaded, apply now
+		if err := q.moveTo(id, parent, name); err != nil {
+			log.Printf("[queue] failed to rename %s: %s", name, err)
+			if node != nil && origin != nil {
+				// show the file where it is on the server
+				node.moveTo(origin, sentName)
+				origin.setRefresh(time.Time{})
+			}
+		}
+	}
+}
+
+// finish updates the node of uploaded item with the info of the new item,
+// and returns it. Must be called with lock held.
+func (q *uploadQueue) finish(item *queueItem, info map[string]interface{}) *fsNode {
+	node := item.node
+	if item.cancelled || node == nil || node.pendingItem() != item {
+		return nil
+	}
+	node.store(info)
+	node.lk.Lock()
+	if node.mime == "" {
+		node.mime = item.Mime
+	}
+	node.pending = nil
+	node.lk.Unlock()
+	if node.Id == "" {
+		// placeholder, which cannot take the identity of the new item
+		// while in use: replace it in the tree
+		if parent := node.getParent(); parent != nil {
+			c := makeNode(info, node.Name(), parent)
+			if c.mime == "" {
+				c.mime = item.Mime
+			}
+			parent.replaceChild(node, c)
+			node = c
+		}
+	}
+	return node
+}
+
+// moveTo moves item id to folder parent as name, trying again if it fails
+func (q *uploadQueue) moveTo(id, parent, name string) error {
+	var err error
+	for i := 1; i <= queueMoveAttempts; i++ {
+		_, err = q.fs.rest("Drive/Item/"+url.PathEscape(id)+":moveTo", "POST", oauth2.RestParam{"target": parent, "rename": decodeName(name)})
+		if err == nil || i == queueMoveAttempts {
+			break
+		}
+		time.Sleep(time.Duration(i) * 5 * time.Second)
+	}
+	return err
+}
+
+// fail gives up item. Its data is kept until queueKeepFailed elapses, and it
+// stays listed in the status meanwhile. Must be called with lock held.
+func (q *uploadQueue) fail(item *queueItem) {
+	log.Printf("[queue] giving up upload of %s after %d attempts: %s", item.Name, item.Attempts, item.LastError)
+	item.Failed = true
+	item.NextTry = time.Now().Add(queueKeepFailed)
+	if err := q.save(item); err != nil {
+		log.Printf("[queue] failed to save state: %s", err)
+	}
+
+	node := item.node
+	item.node = nil
+	if node == nil || node.pendingItem() != item {
+		return
+	}
+	node.setPending(nil)
+	parent := node.getParent()
+	if parent == nil {
+		return
+	}
+	if node.Id == "" {
+		// new file, which does not exist
+		parent.removeChild(node)
+	} else {
+		// show what is on the server again
+		node.setRefresh(time.Time{})
+	}
+	parent.setRefresh(time.Time{})
+}
+
+// status writes a human readable list of pending uploads
+func (q *uploadQueue) status(w io.Writer) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+
+	list := make([]*queueItem, 0, len(q.items))
+	for _, item := range q.items {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	failed := 0
+	for _, item := range list {
+		if item.Failed {
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "%d pending uploads, %d failed\n", len(list)-failed, failed)
+	for _, item := range list {
+		state := "queued"
+		if item.Failed {
+			state = fmt.Sprintf("failed, data kept until %s", item.NextTry.Format(time.RFC3339))
+		} else if item.busy {
+			state = "uploading"
+		} else if item.Attempts > 0 {
+			state = fmt.Sprintf("retry in %s", time.Until(item.NextTry).Truncate(time.Second))
+		}
+		line := []string{item.Created.Format(time.RFC3339), item.Name, fmt.Sprintf("%d bytes", item.Size), state}
+		if item.LastError != "" {
+			line = append(line, fmt.Sprintf("attempts=%d last error: %s", item.Attempts, item.LastError))
+		}
+		fmt.Fprintf(w, "%s\n", strings.Join(line, "\t"))
+	}
+}
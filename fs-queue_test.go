@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/AtOnline/drive-webdav/oauth2"
+)
+
+func TestQueueFail(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fs := testFS(newFakeAPI())
+	q := testQueue(t, fs)
+
+	parent, err := fs.root.get("/Test/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, id, err := q.spool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := q.commit(f, id, parent, nil, "new.txt", "", "text/plain", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := node.pendingItem()
+
+	// network errors are retried without limit
+	for i := 0; i < queueMaxFailures; i++ {
+		q.done(item, nil, errOffline)
+	}
+	if item.Failed {
+		t.Fatalf("upload given up after network errors")
+	}
+
+	refused := &oauth2.ServerError{Message: "parent not found"}
+	for i := 0; i < queueMaxRefused; i++ {
+		if item.Failed {
+			t.Fatalf("upload given up after %d refusals", i)
+		}
+		q.done(item, nil, refused)
+	}
+	if !item.Failed {
+		t.Fatalf("upload not given up after %d refusals", queueMaxRefused)
+	}
+	if _, found := parent.child("new.txt"); found {
+		t.Errorf("placeholder of failed upload still in tree")
+	}
+	if q.hasPending(parent) {
+		t.Errorf("failed upload counts as pending")
+	}
+	if _, err := os.Stat(q.dataPath(item.Id)); err != nil {
+		t.Errorf("data of failed upload not kept: %s", err)
+	}
+	if got, _ := q.next(); got != nil {
+		t.Errorf("failed upload retried")
+	}
+}
+
+// testQueue returns a write-back queue for fs, spooling to a temporary
+// directory
+func testQueue(t *testing.T, fs *DriveFS) *uploadQueue {
+	dir, err := ioutil.TempDir("", "spool-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	q := &uploadQueue{fs: fs, dir: dir, items: make(map[string]*queueItem), wake: make(chan struct{}, 1)}
+	fs.queue = q
+	return q
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AtOnline/drive-webdav/oauth2"
+)
+
+// cacheWarmer loads configured folders and their subfolders in the
+// background, so they are already known when clients browse them. Folders
+// are loaded a few at a time and at a limited rate, to not compete with
+// clients for the API, and pausing when the server asks to slow down. Folders
+// loaded count against max_nodes: they are not dropped while the walk runs,
+// and the walk does not go deeper once the tree is full.
+type cacheWarmer struct {
+	fs *DriveFS
+	lk sync.Mutex
+
+	// progress of the current or last walk
+	started  time.Time
+	finished time.Time
+	loaded   int // folders loaded from the API
+	fresh    int // folders already loaded and not expired
+	failed   int
+	lastErr  string
+}
+
+func newCacheWarmer(fs *DriveFS) *cacheWarmer {
+	w := &cacheWarmer{fs: fs}
+	go w.run()
+	return w
+}
+
+func (w *cacheWarmer) run() {
+	for {
+		if w.fs.isOffline() {
+			log.Printf("[warm] drive is offline, skipping walk")
+		} else {
+			w.walk()
+		}
+		if config.Warm.Interval <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(config.Warm.Interval) * time.Second)
+	}
+}
+
+// warmRetries is how many times a folder is tried again after the server
+// refused to load it for making too many requests
+const warmRetries = 3
+
+// warmBackoff is the first pause after being rate limited, doubled each
+// time the server refuses again, up to warmBackoffMax
+var (
+	warmBackoff    = 5 * time.Second
+	warmBackoffMax = 5 * time.Minute
+)
+
+// warmTask is a folder to visit, or a configured path to resolve if n is nil
+type warmTask struct {
+	n     *fsNode
+	path  string
+	depth int
+	tries int
+}
+
+// warmWalk is the state of a walk, shared by its workers
+type warmWalk struct {
+	w    *cacheWarmer
+	tick <-chan time.Time // pace of loads, nil for no limit
+
+	lk      sync.Mutex
+	cond    *sync.Cond
+	queue   []warmTask
+	pending int           // tasks queued or being visited
+	full    bool          // tree reached max_nodes
+	resume  time.Time     // end of the current pause
+	backoff time.Duration // last pause, 0 if not rate limited
+}
+
+// walk loads configured paths down to the configured depth. A fixed number
+// of workers take folders from a queue, and subfolders are queued as their
+// parent is loaded.
+func (w *cacheWarmer) walk() {
+	w.lk.Lock()
+	w.started, w.finished = time.Now(), time.Time{}
+	w.loaded, w.fresh, w.failed, w.lastErr = 0, 0, 0, ""
+	w.lk.Unlock()
+	log.Printf("[warm] walking %d paths to depth %d", len(config.Warm.Paths), config.Warm.Depth)
+
+	ww := &warmWalk{w: w}
+	ww.cond = sync.NewCond(&ww.lk)
+	if config.Warm.Rate > 0 {
+		// rate is bounded by loadConfig, so the period is never zero
+		t := time.NewTicker(time.Duration(float64(time.Second) / config.Warm.Rate))
+		defer t.Stop()
+		ww.tick = t.C
+	}
+	for _, p := range config.Warm.Paths {
+		ww.push(warmTask{path: p, depth: config.Warm.Depth})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.Warm.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ww.work()
+		}()
+	}
+	wg.Wait()
+
+	if w.fs.tree != nil {
+		// folders loaded can be dropped again as other folders are used
+		w.fs.tree.release()
+	}
+
+	w.lk.Lock()
+	w.finished = time.Now()
+	log.Printf("[warm] walk done in %s: %d folders loaded, %d already loaded, %d failed", w.finished.Sub(w.started).Truncate(time.Second), w.loaded, w.fresh, w.failed)
+	w.lk.Unlock()
+}
+
+// push queues t
+func (ww *warmWalk) push(t warmTask) {
+	ww.lk.Lock()
+	defer ww.lk.Unlock()
+	ww.queue = append(ww.queue, t)
+	ww.pending++
+	ww.cond.Signal()
+}
+
+// work visits queued folders until none are left
+func (ww *warmWalk) work() {
+	for {
+		ww.lk.Lock()
+		for len(ww.queue) == 0 && ww.pending > 0 {
+			ww.cond.Wait()
+		}
+		if len(ww.queue) == 0 {
+			ww.lk.Unlock()
+			return
+		}
+		t := ww.queue[0]
+		ww.queue[0] = warmTask{}
+		ww.queue = ww.queue[1:]
+		ww.lk.Unlock()
+
+		ww.visit(t)
+
+		ww.lk.Lock()
+		ww.pending--
+		if ww.pending == 0 {
+			// wake idle workers so they return
+			ww.cond.Broadcast()
+		}
+		ww.lk.Unlock()
+	}
+}
+
+// visit loads the folder of t, and queues its subfolders
+func (ww *warmWalk) visit(t warmTask) {
+	if ww.w.fs.isOffline() {
+		return
+	}
+
+	n, err := t.n, error(nil)
+	if n == nil {
+		n, err = ww.resolve(t.path)
+	}
+	called := false
+	if err == nil {
+		if !n.IsDir() && !n.isRoot {
+			return
+		}
+		called, err = ww.load(n)
+	}
+	if err != nil {
+		var limited *oauth2.RateLimitError
+		if errors.As(err, &limited) && t.tries < warmRetries {
+			// try again after the pause
+			t.tries++
+			ww.push(t)
+			return
+		}
+		if t.n == nil {
+			n, err = nil, fmt.Errorf("%s: %s", t.path, err)
+		}
+		ww.w.progress(n, err, called)
+		return
+	}
+	ww.w.progress(n, nil, called)
+
+	if t.depth <= 0 || ww.isFull() {
+		return
+	}
+	for _, c := range n.childList() {
+		if c.IsDir() {
+			ww.push(warmTask{n: c, depth: t.depth - 1})
+		}
+	}
+}
+
+// resolve returns the node at path p, loading the folders leading to it at
+// the pace of the walk
+func (ww *warmWalk) resolve(p string) (*fsNode, error) {
+	n := ww.w.fs.root
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		if !n.IsDir() && !n.isRoot {
+			return nil, os.ErrInvalid
+		}
+		if _, err := ww.load(n); err != nil {
+			return nil, err
+		}
+		c, ok := n.lookup(name, false)
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// load loads folder n if it is not loaded or expired, waiting for its turn,
+// and keeps it in memory. It returns true if the API was called.
+func (ww *warmWalk) load(n *fsNode) (bool, error) {
+	called := false
+	if !n.loaded() || time.Since(n.lastRefresh()) >= n.ttl() {
+		ww.wait()
+		n.revalidate()
+		called = true
+		if err := n.loadErr(); err != nil {
+			ww.limited(err)
+			return true, err
+		}
+	}
+
+	if called {
+		ww.lk.Lock()
+		ww.backoff = 0
+		ww.lk.Unlock()
+	}
+	if ww.w.fs.tree != nil {
+		ww.w.fs.tree.keep(n)
+	}
+	return called, nil
+}
+
+// isFull returns true once the tree reached max_nodes, after which no more
+// subfolders are queued
+func (ww *warmWalk) isFull() bool {
+	tree := ww.w.fs.tree
+	if tree == nil || tree.over() < 0 {
+		return false
+	}
+	ww.lk.Lock()
+	defer ww.lk.Unlock()
+	if !ww.full {
+		ww.full = true
+		log.Printf("[warm] max_nodes reached, not loading deeper folders")
+	}
+	return true
+}
+
+// wait blocks until the next load is allowed
+func (ww *warmWalk) wait() {
+	for {
+		ww.lk.Lock()
+		d := time.Until(ww.resume)
+		ww.lk.Unlock()
+		if d <= 0 {
+			break
+		}
+		time.Sleep(d)
+	}
+	if ww.tick != nil {
+		<-ww.tick
+	}
+}
+
+// limited pauses all workers if err means the server refused a load for
+// making too many requests, for as long as it asked and at least for a
+// backoff doubled each time
+func (ww *warmWalk) limited(err error) {
+	var limited *oauth2.RateLimitError
+	if !errors.As(err, &limited) {
+		return
+	}
+	ww.lk.Lock()
+	defer ww.lk.Unlock()
+
+	if time.Now().Before(ww.resume) {
+		// refused while another worker's load started the pause
+		return
+	}
+	switch {
+	case ww.backoff == 0:
+		ww.backoff = warmBackoff
+	case ww.backoff < warmBackoffMax:
+		ww.backoff *= 2
+		if ww.backoff > warmBackoffMax {
+			ww.backoff = warmBackoffMax
+		}
+	}
+	d := ww.backoff
+	if limited.RetryAfter > d {
+		d = limited.RetryAfter
+	}
+	ww.resume = time.Now().Add(d)
+	log.Printf("[warm] rate limited by server, pausing for %s", d)
+}
+
+// progress records the visit of folder n
+func (w *cacheWarmer) progress(n *fsNode, err error, loaded bool) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	switch {
+	case err != nil:
+		w.failed++
+		w.lastErr = err.Error()
+		if n != nil {
+			w.lastErr = n.path() + ": " + w.lastErr
+		}
+		log.Printf("[warm] failed to load %s", w.lastErr)
+	case loaded:
+		w.loaded++
+		if w.loaded%100 == 0 {
+			log.Printf("[warm] %d folders loaded so far", w.loaded)
+		}
+	default:
+		w.fresh++
+	}
+}
+
+// status writes the progress of the warmer to out
+func (w *cacheWarmer) status(out io.Writer) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+
+	state := "waiting"
+	switch {
+	case !w.finished.IsZero():
+		state = fmt.Sprintf("last walk finished %s", w.finished.Format(time.RFC3339))
+	case !w.started.IsZero():
+		state = fmt.Sprintf("walking since %s", w.started.Format(time.RFC3339))
+	}
+	fmt.Fprintf(out, "warmer: %s, %d folders loaded, %d already loaded, %d failed\n", state, w.loaded, w.fresh, w.failed)
+	if w.lastErr != "" {
+		fmt.Fprintf(out, "warmer: last error: %s\n", w.lastErr)
+	}
+}
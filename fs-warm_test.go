@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWarmWalk(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	defer func(c WarmConfig, b time.Duration) { config.Warm, warmBackoff = c, b }(config.Warm, warmBackoff)
+	config.Warm = WarmConfig{Paths: []string{"/Test"}, Depth: 1, Concurrency: 2}
+	warmBackoff = 10 * time.Millisecond
+
+	api := newFakeAPI()
+	api.refuse = 2
+	fs := testFS(api)
+	w := &cacheWarmer{fs: fs}
+	w.walk()
+
+	if w.failed != 0 || w.loaded != 3 {
+		t.Errorf("expected 3 folders loaded and none failed, got %d loaded, %d failed (%s)", w.loaded, w.failed, w.lastErr)
+	}
+	if api.refuse != 0 || api.lists != 3 {
+		t.Errorf("expected 2 refused then 3 listings, got %d left to refuse and %d listings", api.refuse, api.lists)
+	}
+	// root, Test, a and b were loaded, and are no longer protected
+	if over := fs.tree.over(); over != 25-config.MaxNodes {
+		t.Errorf("expected 25 nodes counted, got %d", over+config.MaxNodes)
+	}
+	if n, _ := fs.root.get("/Test/a"); n == nil || fs.tree.isKept(n) {
+		t.Errorf("warmed folder still protected after the walk")
+	}
+}
+
+func TestWarmFull(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	defer func(c WarmConfig) { config.Warm = c }(config.Warm)
+	config.Warm = WarmConfig{Paths: []string{"/Test"}, Depth: 2, Concurrency: 1}
+
+	api := newFakeAPI()
+	for i := 0; i < 10; i++ {
+		api.add(fmt.Sprintf("a-g%d", i), "a", fmt.Sprintf("g%d.txt", i), "file")
+	}
+	fs := testFS(api)
+	w := &cacheWarmer{fs: fs}
+	w.walk()
+
+	// with /Test, a (21 nodes) and b (11 nodes) loaded, the tree is above
+	// max_nodes (30): a/sub was queued before, b/sub is not
+	if w.loaded != 4 {
+		t.Errorf("expected 4 folders loaded before reaching max_nodes, got %d", w.loaded)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The API exposes no change cursor or delta listing, so remote changes are
+// detected by listing folders again at a regular interval. To bound the
+// cost, only the drives list and folders recently used by clients are
+// polled, up to watch_max listings per round. Reloads patch the tree in
+// place, and differences with the previous listing are published as events
+// to subscribers of the change feed.
+
+const (
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+)
+
+type changeEvent struct {
+	Type string    `json:"type"`
+	Path string    `json:"path"`
+	Id   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// changeFeed dispatches change events to subscribers. Events are dropped
+// for subscribers which do not keep up.
+type changeFeed struct {
+	subs map[chan changeEvent]struct{}
+	lk   sync.Mutex
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subs: make(map[chan changeEvent]struct{})}
+}
+
+// subscribe returns a channel receiving change events, and a function to
+// call when done
+func (f *changeFeed) subscribe() (<-chan changeEvent, func()) {
+	ch := make(chan changeEvent, 256)
+	f.lk.Lock()
+	f.subs[ch] = struct{}{}
+	f.lk.Unlock()
+
+	return ch, func() {
+		f.lk.Lock()
+		defer f.lk.Unlock()
+		delete(f.subs, ch)
+	}
+}
+
+func (f *changeFeed) publish(ev changeEvent) {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func appendChange(changes []changeEvent, op string, n *fsNode) []changeEvent {
+	if op == "" {
+		return changes
+	}
+	return append(changes, changeEvent{Type: op, Path: n.path(), Id: n.Id})
+}
+
+// notifyChanges publishes changes found when reloading folder n, including
+// removed children
+func (fs *DriveFS) notifyChanges(n *fsNode, changes []changeEvent, removed map[string]*fsNode) {
+	dir := n.path()
+	for _, c := range removed {
+		changes = append(changes, changeEvent{Type: changeDeleted, Path: path.Join(dir, c.Name()), Id: c.Id})
+	}
+	now := time.Now()
+	for _, ev := range changes {
+		ev.Time = now
+		log.Printf("[watch] %s %s", ev.Type, ev.Path)
+		fs.changes.publish(ev)
+	}
+}
+
+// watch polls for remote changes until the process exits
+func (fs *DriveFS) watch() {
+	for {
+		time.Sleep(time.Duration(config.WatchInterval) * time.Second)
+		if fs.isOffline() {
+			continue
+		}
+		fs.poll()
+	}
+}
+
+// poll lists again the drives list and watched folders
+func (fs *DriveFS) poll() {
+	fs.reload(fs.root)
+	for _, n := range fs.watched() {
+		if fs.isOffline() {
+			return
+		}
+		fs.reload(n)
+	}
+}
+
+func (fs *DriveFS) reload(n *fsNode) {
+	n.refreshL.Lock()
+	defer n.refreshL.Unlock()
+	n.loadInternal()
+}
+
+// watched returns loaded folders used in the last watch_recent seconds and
+// not reloaded during the last watch interval, most recently used first, up
+// to watch_max folders
+func (fs *DriveFS) watched() []*fsNode {
+	used := time.Now().Add(-time.Duration(config.WatchRecent) * time.Second)
+	fresh := time.Now().Add(-time.Duration(config.WatchInterval) * time.Second)
+
+	var list []*fsNode
+	var walk func(n *fsNode)
+	walk = func(n *fsNode) {
+		for _, c := range n.childList() {
+			// folders are used after their parent, see get()
+			if !c.IsDir() || !c.loaded() || c.lastUse().Before(used) {
+				continue
+			}
+			if c.lastRefresh().Before(fresh) {
+				list = append(list, c)
+			}
+			walk(c)
+		}
+	}
+	walk(fs.root)
+
+	sort.Slice(list, func(i, j int) bool { return list[i].lastUse().After(list[j].lastUse()) })
+	if config.WatchMax > 0 && len(list) > config.WatchMax {
+		list = list[:config.WatchMax]
+	}
+	return list
+}
+
+// serveChanges streams change events to the client as server-sent events
+func (fs *DriveFS) serveChanges(w http.ResponseWriter, r *http.Request) {
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, done := fs.changes.subscribe()
+	defer done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fl.Flush()
+
+	for {
+		select {
+		case ev := <-ch:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			fl.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatched(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fs := testFS(newFakeAPI())
+	var nodes []*fsNode
+	for _, p := range []string{"/Test/a", "/Test/b", "/Test/a/sub"} {
+		n, err := fs.root.get(p + "/f0.txt")
+		if err != nil {
+			t.Fatalf("%s: %s", p, err)
+		}
+		nodes = append(nodes, n.getParent())
+	}
+	a, b, sub := nodes[0], nodes[1], nodes[2]
+	if l := fs.watched(); len(l) != 0 {
+		t.Errorf("fresh folders are watched: %d", len(l))
+	}
+
+	old := time.Now().Add(-2 * time.Duration(config.WatchInterval) * time.Second)
+	for _, n := range nodes {
+		n.setRefresh(old)
+	}
+	atomic.StoreInt64(&b.used, time.Now().Add(-2*time.Duration(config.WatchRecent)*time.Second).Unix())
+	atomic.StoreInt64(&a.used, time.Now().Unix()-1)
+	l := fs.watched()
+	if len(l) != 2 || l[0] != sub || l[1] != a {
+		t.Errorf("expected /Test/a/sub then /Test/a, got %d folders", len(l))
+	}
+
+	defer func(max int) { config.WatchMax = max }(config.WatchMax)
+	config.WatchMax = 1
+	if l := fs.watched(); len(l) != 1 || l[0] != sub {
+		t.Errorf("expected /Test/a/sub only, got %d folders", len(l))
+	}
+}
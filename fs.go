@@ -4,7 +4,12 @@ import (
 	"context"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
+	"github.com/AtOnline/drive-webdav/blockcache"
+	"github.com/AtOnline/drive-webdav/cfgpath"
 	"github.com/AtOnline/drive-webdav/oauth2"
 	"golang.org/x/net/webdav"
 )
@@ -14,13 +19,72 @@ type DriveFS struct {
 
 	// cache path → node
 	root *fsNode
+
+	queue *uploadQueue      // write-back queue, if enabled
+	cache *blockcache.Cache // downloaded data, if enabled
+	pins  *pinManager       // offline paths, if cache is enabled
+
+	changes *changeFeed  // remote changes
+	names   *nameMap     // names given to duplicates
+	meta    *metaStore   // folder contents on disk, if enabled
+	tree    *treeLRU     // loaded folders, if memory is limited
+	warm    *cacheWarmer // background loads, if paths are configured
+
+	// blob → sha256 of content, for blobs we know the hash of
+	hashes  map[string]string
+	hashesL sync.RWMutex
+
+	// set while the API cannot be reached
+	offlineSince time.Time
+	offlineErr   error
+	offlineL     sync.Mutex
 }
 
 func NewDriveFS(c *oauth2.OAuth2) *DriveFS {
 	res := &DriveFS{
-		c: c,
+		c:       c,
+		hashes:  make(map[string]string),
+		changes: newChangeFeed(),
+		names:   newNameMap(filepath.Join(cfgpath.GetCacheDir(), "names")),
+	}
+	res.root = newRoot(res)
+	cleanStaging()
+
+	if config.CacheSize > 0 {
+		c, err := blockcache.New(filepath.Join(cfgpath.GetCacheDir(), "blocks"), config.CacheSize)
+		if err != nil {
+			log.Printf("Failed to initialize block cache: %s", err)
+		} else {
+			res.cache = c
+		}
+	}
+
+	if config.WriteBack {
+		q, err := newUploadQueue(res)
+		if err != nil {
+			log.Printf("Failed to initialize write-back queue, uploads will be synchronous: %s", err)
+		} else {
+			res.queue = q
+		}
+	}
+
+	if config.MaxNodes > 0 {
+		res.tree = newTreeLRU(res)
+	}
+
+	if config.MetaCache {
+		res.meta = newMetaStore(res, filepath.Join(cfgpath.GetCacheDir(), "meta.db"))
+	}
+
+	if res.cache != nil {
+		res.pins = newPinManager(res)
+	}
+	if config.WatchInterval > 0 {
+		go res.watch()
+	}
+	if len(config.Warm.Paths) > 0 {
+		res.warm = newCacheWarmer(res)
 	}
-	res.root = &fsNode{fs: res, isRoot: true}
 	return res
 }
 
@@ -35,7 +99,7 @@ func (fs *DriveFS) OpenFile(ctx context.Context, name string, flag int, perm os.
 }
 
 func (fs *DriveFS) RemoveAll(ctx context.Context, name string) error {
-	d, err := fs.root.get(name)
+	d, err := fs.root.resolve(ctx, name)
 	if err != nil {
 		return err
 	}
@@ -48,5 +112,27 @@ func (fs *DriveFS) Rename(ctx context.Context, oldName, newName string) error {
 }
 
 func (fs *DriveFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
-	return fs.root.get(name)
+	return fs.root.resolve(ctx, name)
+}
+
+// blobHash returns the known sha256 of a blob's content, or an empty string
+func (fs *DriveFS) blobHash(blob string) string {
+	if blob == "" {
+		return ""
+	}
+	fs.hashesL.RLock()
+	defer fs.hashesL.RUnlock()
+	return fs.hashes[blob]
+}
+
+// setBlobHash records the sha256 of a blob. It must come from the API or
+// from data we uploaded, never from a download which may be corrupted.
+func (fs *DriveFS) setBlobHash(blob, hash string) {
+	if blob == "" || hash == "" {
+		return
+	}
+	fs.hashesL.Lock()
+	fs.hashes[blob] = hash
+	fs.hashesL.Unlock()
+	fs.meta.setHash(blob, hash)
 }
@@ -1,8 +1,14 @@
 module github.com/AtOnline/drive-webdav
 
+go 1.17
+
 require (
 	github.com/MagicalTux/goro v0.0.0-20181202174014-271b4c5c6b8d
 	github.com/MagicalTux/ringbuf v0.1.2
 	github.com/TrisTech/goupd v0.1.2
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20190119204137-ed066c81e75e
+	golang.org/x/text v0.13.0
 )
+
+require golang.org/x/sys v0.5.0 // indirect
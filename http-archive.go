@@ -0,0 +1,185 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/AtOnline/drive-webdav/bwlimit"
+)
+
+// archiveWriter is implemented by zip and tar output
+type archiveWriter interface {
+	dir(name string, n *fsNode) error
+	file(name string, n *fsNode, size int64) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (z zipArchive) dir(name string, n *fsNode) error {
+	_, err := z.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: n.ModTime()})
+	return err
+}
+
+func (z zipArchive) file(name string, n *fsNode, size int64) (io.Writer, error) {
+	h := &zip.FileHeader{Name: name, Modified: n.ModTime(), Method: zip.Deflate}
+	h.SetMode(0644)
+	return z.CreateHeader(h)
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (t tarArchive) dir(name string, n *fsNode) error {
+	return t.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: n.ModTime()})
+}
+
+func (t tarArchive) file(name string, n *fsNode, size int64) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: n.ModTime()})
+	return t.Writer, err
+}
+
+// serveArchive answers GET /folder?archive=zip (or tar) with an archive of
+// the folder built on the fly. Files larger than the optional max_size
+// parameter are skipped. Returns false if the request is not for a folder.
+func (fs *DriveFS) serveArchive(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	n, err := fs.root.find(r.URL.Path, foldCase(r))
+	if err != nil || n.Type != "folder" {
+		return false
+	}
+	if n.isRoot {
+		http.Error(w, "cannot archive the list of drives", http.StatusBadRequest)
+		return true
+	}
+
+	maxSize := int64(-1)
+	if v := q.Get("max_size"); v != "" {
+		maxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxSize < 0 {
+			http.Error(w, "invalid value for max_size", http.StatusBadRequest)
+			return true
+		}
+	}
+
+	name := n.Name()
+	format := q.Get("archive")
+	if format != "zip" && format != "tar" {
+		http.Error(w, "archive must be zip or tar", http.StatusBadRequest)
+		return true
+	}
+
+	// errors found before anything is sent get a proper status
+	n.reloadData()
+	if err := n.loadErr(); err != nil {
+		archiveError(w, r, err)
+		return true
+	}
+
+	out := &startWriter{ResponseWriter: w}
+	var a archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		name += ".zip"
+		a = zipArchive{zip.NewWriter(out)}
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		name += ".tar"
+		a = tarArchive{tar.NewWriter(out)}
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	log.Printf("Streaming %s as %s", r.URL.Path, name)
+	_, down := requestLimiters(r.Context())
+	err = archiveWalk(a, n, n.Name(), maxSize, down)
+	if err == nil {
+		err = a.Close()
+	}
+	if err != nil {
+		if !out.started {
+			w.Header().Del("Content-Disposition")
+			archiveError(w, r, err)
+			return true
+		}
+		// headers are gone already, reset the connection so the client
+		// does not take a truncated archive for a complete one
+		log.Printf("archive of %s failed: %s", r.URL.Path, err)
+		panic(http.ErrAbortHandler)
+	}
+	return true
+}
+
+// archiveError answers an archive request which failed before sending data
+func archiveError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("archive of %s failed: %s", r.URL.Path, err)
+	status := http.StatusBadGateway
+	if err == errOffline {
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// startWriter records whether the response body has started
+type startWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (s *startWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.ResponseWriter.Write(p)
+}
+
+// archiveWalk adds n and its children to a, as name
+func archiveWalk(a archiveWriter, n *fsNode, name string, maxSize int64, down []*bwlimit.Limiter) error {
+	if n.Type == "folder" {
+		n.reloadData()
+		if err := n.loadErr(); err != nil {
+			return err
+		}
+		if err := a.dir(name, n); err != nil {
+			return err
+		}
+
+		list := n.childList()
+		sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+		for _, c := range list {
+			if err := archiveWalk(a, c, path.Join(name, c.Name()), maxSize, down); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if n.contentKind() == contentUnavailable {
+		log.Printf("archive: skipping %s, content not available", name)
+		return nil
+	}
+	size := n.Size()
+	if maxSize >= 0 && size > maxSize {
+		log.Printf("archive: skipping %s, %d bytes", name, size)
+		return nil
+	}
+
+	dst, err := a.file(name, n, size)
+	if err != nil {
+		return err
+	}
+	f := &fsNodeFile{self: n, flag: os.O_RDONLY, downLimit: down}
+	defer f.Close()
+	c, err := io.Copy(dst, f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if c != size {
+		return fmt.Errorf("%s: got %d bytes instead of %d", name, c, size)
+	}
+	return nil
+}
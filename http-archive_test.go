@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestArchiveError(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	api := newFakeAPI()
+	fs := testFS(api)
+	f, err := fs.root.get("/Test/a/f0.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// folder listing refused by the server
+	f.getParent().setRefresh(time.Time{})
+	api.lk.Lock()
+	api.refuse = 1
+	api.lk.Unlock()
+	w := httptest.NewRecorder()
+	if !fs.serveArchive(w, httptest.NewRequest("GET", "/Test/a?archive=zip", nil)) {
+		t.Fatal("archive request not handled")
+	}
+	if w.Code != http.StatusBadGateway || w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("got status %d, disposition %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// wantRedirect returns true if redirect mode applies to request r
+func wantRedirect(r *http.Request) bool {
+	c := &config.Redirect
+	if !c.Enabled || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+
+	ua := r.Header.Get("User-Agent")
+	for _, s := range c.Exclude {
+		if strings.Contains(ua, s) {
+			return false
+		}
+	}
+	if len(c.UserAgents) > 0 && !matchAny(c.UserAgents, func(s string) bool { return strings.Contains(ua, s) }) {
+		return false
+	}
+	if len(c.Paths) > 0 && !matchAny(c.Paths, func(s string) bool { return strings.HasPrefix(r.URL.Path, s) }) {
+		return false
+	}
+	return true
+}
+
+func matchAny(list []string, f func(string) bool) bool {
+	for _, s := range list {
+		if f(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveRedirect sends the client to the storage url of the requested file.
+// Returns false if the request should be proxied instead.
+func (fs *DriveFS) serveRedirect(w http.ResponseWriter, r *http.Request) bool {
+	n, err := fs.root.find(r.URL.Path, foldCase(r))
+	if err != nil || n.Type != "file" || n.pendingItem() != nil || n.contentKind() != contentNormal {
+		// let webdav handle it
+		return false
+	}
+
+	u, err := n.freshUrl()
+	if err != nil || u == "" {
+		if err != nil {
+			log.Printf("redirect: failed to get url for %s, proxying: %s", r.URL.Path, err)
+		}
+		return false
+	}
+
+	http.Redirect(w, r, u, http.StatusFound)
+	return true
+}
@@ -17,6 +17,13 @@ type HttpServer struct {
 	l *net.TCPListener
 }
 
+type ctxKey int
+
+const (
+	ctxKeyRequest  ctxKey = iota // *http.Request being served
+	ctxKeyLimiters               // download limiters
+)
+
 const (
 	authEP      = "https://hub.atonline.com/_special/rest/OAuth2:auth"
 	tokenEP     = "https://hub.atonline.com/_special/rest/OAuth2:token"
@@ -64,7 +71,7 @@ func (h *HttpServer) LoginUrl() string {
 }
 
 func (h *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
+	if r.Method == "GET" || r.Method == "POST" {
 		switch r.URL.Path {
 		case "/_login":
 			c, err := oauth2.NewOAuth2(tokenEP, clientId, redirectUri, r.URL.Query().Get("code"))
@@ -72,7 +79,12 @@ func (h *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				fmt.Fprintf(w, "Error authenticating: %s", err)
 				return
 			}
+			if old, ok := h.Handler.FileSystem.(*DriveFS); ok {
+				// release the store for the new file system
+				old.meta.close()
+			}
 			fs := NewDriveFS(c)
+			fs.meta.dropDrives()
 			h.Handler.FileSystem = fs
 			h.Handler.LockSystem = webdav.NewMemLS() // TODO
 			fmt.Fprintf(w, "READY, you can now browse dav://%s", h)
@@ -80,11 +92,121 @@ func (h *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "/_log":
 			LogDmesg(w)
 			return
+		case "/_bandwidth":
+			serveBandwidth(w, r)
+			return
+		case "/_pin":
+			if fs, ok := h.Handler.FileSystem.(*DriveFS); ok {
+				fs.servePin(w, r)
+			} else {
+				fmt.Fprintf(w, "not logged in\n")
+			}
+			return
+		case "/_changes":
+			if fs, ok := h.Handler.FileSystem.(*DriveFS); ok {
+				fs.serveChanges(w, r)
+			} else {
+				fmt.Fprintf(w, "not logged in\n")
+			}
+			return
+		case "/_status":
+			if fs, ok := h.Handler.FileSystem.(*DriveFS); ok {
+				fmt.Fprintf(w, "%s\n", fs.connStatus())
+				if fs.warm != nil {
+					fs.warm.status(w)
+				}
+			} else {
+				fmt.Fprintf(w, "not logged in\n")
+			}
+			return
+		case "/_refresh":
+			if fs, ok := h.Handler.FileSystem.(*DriveFS); ok {
+				fs.serveRefresh(w, r)
+			} else {
+				fmt.Fprintf(w, "not logged in\n")
+			}
+			return
+		case "/_queue":
+			if fs, ok := h.Handler.FileSystem.(*DriveFS); ok && fs.queue != nil {
+				fs.queue.status(w)
+			} else {
+				fmt.Fprintf(w, "write-back is disabled\n")
+			}
+			return
+		}
+	}
+
+	// make request available to filesystem calls
+	r = r.WithContext(context.WithValue(r.Context(), ctxKeyRequest, r))
+
+	if fs, ok := h.Handler.FileSystem.(*DriveFS); ok {
+		if fs.serveOffline(w, r) {
+			return
+		}
+		if r.Method == "PROPFIND" && noCache(r) {
+			if err := fs.refresh(r.URL.Path); err != nil {
+				log.Printf("refresh of %s failed: %s", r.URL.Path, err)
+			}
+		}
+		if fs.serveUnavailable(w, r) {
+			return
+		}
+		if r.Method == "GET" && r.URL.Query().Get("archive") != "" && fs.serveArchive(w, r) {
+			return
+		}
+		if wantRedirect(r) && fs.serveRedirect(w, r) {
+			return
 		}
 	}
 	h.Handler.ServeHTTP(w, r)
 }
 
+// controlAllowed checks that a request changing state through a control
+// endpoint comes from a local client rather than from a web page the user
+// happens to visit: it must be a POST for this server, and if the browser
+// tells where it comes from, from this server too. Writes an error and
+// returns false otherwise.
+func controlAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "changes require a POST request", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !isLocalHost(r.Host) {
+		// DNS rebinding
+		http.Error(w, "invalid host", http.StatusForbidden)
+		return false
+	}
+	if o := r.Header.Get("Origin"); o != "" {
+		u, err := url.Parse(o)
+		if err != nil || u.Host != r.Host {
+			http.Error(w, "cross origin requests are not allowed", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// isLocalHost returns true if host, from a Host header, designates this
+// server
+func isLocalHost(host string) bool {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		h = host
+	}
+	return h == "localhost" || h == "127.0.0.1"
+}
+
+// requestFromContext returns the http request a filesystem call is made for,
+// or nil if not called from a request
+func requestFromContext(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(ctxKeyRequest).(*http.Request)
+	return r
+}
+
 func (h *HttpServer) Stop() {
 	h.l.Close()
+	if fs, ok := h.Handler.FileSystem.(*DriveFS); ok && fs.meta != nil {
+		fs.meta.close()
+	}
 }
@@ -31,6 +31,8 @@ func setupSignals() {
 func main() {
 	setupSignals()
 	goupd.AutoUpdate(false)
+	loadConfig()
+	startBandwidth()
 
 	t := tray.Init(shutdown)
 	h, err := NewHttpServer()
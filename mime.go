@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"path"
+	"strings"
+)
+
+// mimeTypes covers common extensions so results do not depend on the mime
+// tables installed on the system
+var mimeTypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".aac":  "audio/aac",
+	".avi":  "video/x-msvideo",
+	".bmp":  "image/bmp",
+	".css":  "text/css",
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".epub": "application/epub+zip",
+	".flac": "audio/flac",
+	".gif":  "image/gif",
+	".gz":   "application/gzip",
+	".heic": "image/heic",
+	".htm":  "text/html",
+	".html": "text/html",
+	".ico":  "image/vnd.microsoft.icon",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".js":   "application/javascript",
+	".json": "application/json",
+	".m4a":  "audio/mp4",
+	".md":   "text/markdown",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ogg":  "audio/ogg",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".psd":  "image/vnd.adobe.photoshop",
+	".rar":  "application/vnd.rar",
+	".rtf":  "application/rtf",
+	".svg":  "image/svg+xml",
+	".tar":  "application/x-tar",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".txt":  "text/plain",
+	".wav":  "audio/wav",
+	".webm": "video/webm",
+	".webp": "image/webp",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xml":  "application/xml",
+	".zip":  "application/zip",
+}
+
+// mimeByName returns the mime type for a file name based on its extension,
+// or an empty string if unknown
+func mimeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := mimeTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// uploadMime returns the content type to use when uploading a file named
+// name: the type given by the client if any, else a type guessed from the
+// extension. An empty string means data should be sniffed.
+func uploadMime(ctx context.Context, name string) string {
+	if r := requestFromContext(ctx); r != nil && r.Method == "PUT" {
+		t := r.Header.Get("Content-Type")
+		if mt, _, err := mime.ParseMediaType(t); err == nil && mt != "application/octet-stream" {
+			// octet-stream is sent by many clients by default, do not trust it
+			return t
+		}
+	}
+	return mimeByName(name)
+}
@@ -2,6 +2,7 @@ package oauth2
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
@@ -12,6 +13,8 @@ import (
 	"sort"
 	"strings"
 	"time"
+
+	"github.com/AtOnline/drive-webdav/bwlimit"
 )
 
 type awsInitiateMultipartUploadResult struct {
@@ -37,13 +40,19 @@ var awsClient = &http.Client{
 	},
 }
 
+// limitBody returns a request body for data, throttled by the upload's
+// limiters
+func (u *Upload) limitBody(data []byte) io.ReadCloser {
+	return ioutil.NopCloser(bwlimit.NewReader(context.Background(), bytes.NewReader(data), u.Limiters...))
+}
+
 func (u *Upload) awsReq(req *http.Request, body []byte) (*http.Response, error) {
 	// perform aws request
 	bodyHash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256('')
 	if body != nil {
-		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.Body = u.limitBody(body)
 		req.GetBody = func() (io.ReadCloser, error) {
-			return ioutil.NopCloser(bytes.NewReader(body)), nil
+			return u.limitBody(body), nil
 		}
 		req.ContentLength = int64(len(body))
 		hash := sha256.New()
@@ -62,6 +62,11 @@ func NewOAuth2(endpoint, clientId, redirectUri, code string) (*OAuth2, error) {
 	return res, res.storeToken(body)
 }
 
+// ClientId returns the client id the token was obtained for
+func (o *OAuth2) ClientId() string {
+	return o.clientId
+}
+
 func FromDisk(clientId, endpoint string) (*OAuth2, error) {
 	p := filepath.Join(cfgpath.GetConfigDir(), clientId+".json")
 	f, err := os.Open(p)
@@ -217,6 +222,16 @@ type RestResponse struct {
 	RedirectCode int    `json:"redirect_code"`
 }
 
+// ServerError is an error reported by the API in its response, as opposed to
+// a failure to reach it
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "[rest] error from server: " + e.Message
+}
+
 func (o *OAuth2) Rest(req, method string, param RestParam) (*RestResponse, error) {
 	// build http request
 	r := &http.Request{
@@ -268,6 +283,11 @@ func (o *OAuth2) Rest(req, method string, param RestParam) (*RestResponse, error
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		log.Printf("[rest] %s %s => rate limited", method, req)
+		return nil, rateLimitError(resp)
+	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -294,7 +314,7 @@ func (o *OAuth2) Rest(req, method string, param RestParam) (*RestResponse, error
 	}
 
 	if result.Result == "error" {
-		return nil, fmt.Errorf("[rest] error from server: %s", result.Error)
+		return nil, &ServerError{Message: result.Error}
 	}
 
 	return result, nil
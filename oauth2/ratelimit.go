@@ -0,0 +1,36 @@
+package oauth2
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimitError is returned by Rest when the server refused a request
+// because too many were made
+type RateLimitError struct {
+	RetryAfter time.Duration // delay requested by the server, 0 if none
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return "[rest] rate limited by server, retry after " + e.RetryAfter.String()
+	}
+	return "[rest] rate limited by server"
+}
+
+// rateLimitError builds the error for a 429 response, using its Retry-After
+// header given either in seconds or as a date
+func rateLimitError(resp *http.Response) error {
+	e := &RateLimitError{}
+	v := resp.Header.Get("Retry-After")
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		e.RetryAfter = time.Duration(s) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		e.RetryAfter = time.Until(t)
+	}
+	if e.RetryAfter < 0 {
+		e.RetryAfter = 0
+	}
+	return e
+}
@@ -3,23 +3,43 @@ package oauth2
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+
+	"github.com/AtOnline/drive-webdav/bwlimit"
 )
 
-const uploadBlockLen = 5 * 1024 * 1024
 const awsTimeFormat = "20060102T150405Z"
 
+// S3 multipart upload limits
+const (
+	uploadMinPartLen   = 5 * 1024 * 1024        // all parts but the last one must be at least 5MB
+	uploadMaxPartLen   = 5 * 1024 * 1024 * 1024 // 5GB
+	uploadMaxParts     = 10000
+	uploadMaxObjectLen = 5 * 1024 * 1024 * 1024 * 1024 // 5TB
+
+	// when size is unknown, part size doubles every uploadGrowParts parts,
+	// which allows reaching about 5TB before running out of parts
+	uploadGrowParts = 1000
+)
+
+var ErrUploadTooLarge = errors.New("upload exceeds maximum object size")
+
 type Upload struct {
 	o           *OAuth2
+	req         string
+	param       RestParam
 	buf         *bytes.Buffer
 	pos         int64
-	committed   int64 // sent so far
-	maxLen      int
-	ContentType string
+	committed   int64  // sent so far
+	size        int64  // expected size, or -1 if unknown
+	partLen     int64  // size of parts when expected size is known
+	ContentType string // guessed from data if not set before upload starts
+	Limiters    []*bwlimit.Limiter
 
 	chunks []string
 
@@ -36,43 +56,112 @@ type Upload struct {
 	awsUrl     string // combined of previous things
 }
 
+// NewUpload prepares an upload through API endpoint req. The endpoint is
+// only called once data needs to be sent, so that the content type can be
+// guessed from the first bytes.
 func NewUpload(o *OAuth2, req string, param RestParam) (*Upload, error) {
-	apires, err := o.Rest(req, "POST", param)
+	res := &Upload{o: o, req: req, param: param, size: -1, partLen: uploadMinPartLen, buf: &bytes.Buffer{}}
+	return res, nil
+}
+
+func (u *Upload) start() error {
+	if u.upid != "" {
+		return nil
+	}
+
+	if u.ContentType == "" {
+		// need to guess content type from what we have buffered
+		u.ContentType = http.DetectContentType(u.buf.Bytes())
+	}
+
+	param := RestParam{"type": u.ContentType}
+	for k, v := range u.param {
+		param[k] = v
+	}
+
+	apires, err := u.o.Rest(u.req, "POST", param)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	data := apires.Data.(map[string]interface{})
 
 	// we should be getting some data
-	res := &Upload{o: o, upload: data, maxLen: uploadBlockLen, buf: &bytes.Buffer{}}
-	res.upid = data["Cloud_Aws_Bucket_Upload__"].(string)
-	res.putUrl = data["PUT"].(string)
-	res.complete = data["Complete"].(string)
+	u.upload = data
+	u.upid = data["Cloud_Aws_Bucket_Upload__"].(string)
+	u.putUrl = data["PUT"].(string)
+	u.complete = data["Complete"].(string)
 
 	bucket := data["Bucket_Endpoint"].(map[string]interface{})
-	res.bucketHost = bucket["Host"].(string)
-	res.bucketName = bucket["Name"].(string)
-	res.region = bucket["Region"].(string)
-	res.key = data["Key"].(string)
-	res.awsUrl = "https://" + res.bucketHost + "/" + res.bucketName + "/" + res.key
+	u.bucketHost = bucket["Host"].(string)
+	u.bucketName = bucket["Name"].(string)
+	u.region = bucket["Region"].(string)
+	u.key = data["Key"].(string)
+	u.awsUrl = "https://" + u.bucketHost + "/" + u.bucketName + "/" + u.key
 
-	return res, nil
+	return nil
 }
 
 func (u *Upload) Len() int64 {
 	return u.pos
 }
 
+// SetSize sets the expected final size of the upload, typically from a
+// Content-Length header, so parts can be sized to fit S3's part limit. It
+// must be called before any data is written.
+func (u *Upload) SetSize(size int64) error {
+	if size > uploadMaxObjectLen {
+		return ErrUploadTooLarge
+	}
+	u.size = size
+
+	// smallest part size allowing the whole file to fit, rounded up to 1MB
+	partLen := (size + uploadMaxParts - 1) / uploadMaxParts
+	partLen = (partLen + 1024*1024 - 1) &^ (1024*1024 - 1)
+	if partLen < uploadMinPartLen {
+		partLen = uploadMinPartLen
+	}
+	if partLen > uploadMaxPartLen {
+		partLen = uploadMaxPartLen
+	}
+	u.partLen = partLen
+	return nil
+}
+
+// nextPartLen returns the size of the part currently being buffered
+func (u *Upload) nextPartLen() int64 {
+	partLen := u.partLen
+	if u.size < 0 || u.pos > u.size {
+		// size unknown (or client lied), grow geometrically
+		grow := int64(uploadMinPartLen) << uint(len(u.chunks)/uploadGrowParts)
+		if grow > partLen {
+			partLen = grow
+		}
+	}
+	if partLen > uploadMaxPartLen {
+		partLen = uploadMaxPartLen
+	}
+	return partLen
+}
+
 func (u *Upload) Complete() (*RestResponse, error) {
+	if err := u.start(); err != nil {
+		return nil, err
+	}
+
 	// finalize upload
 	if len(u.chunks) == 0 {
 		// perform regular PUT upload
 		log.Printf("Performing PUT upload (%d bytes)", u.buf.Len())
-		req, err := http.NewRequest("PUT", u.putUrl, bytes.NewReader(u.buf.Bytes()))
+		req, err := http.NewRequest("PUT", u.putUrl, u.limitBody(u.buf.Bytes()))
 		if err != nil {
 			return nil, err
 		}
+		req.ContentLength = int64(u.buf.Len())
+		if req.ContentLength == 0 {
+			req.Body = http.NoBody
+		}
+		req.Header.Set("Content-Type", u.ContentType)
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return nil, err
@@ -117,33 +206,48 @@ func (u *Upload) Complete() (*RestResponse, error) {
 }
 
 func (u *Upload) Write(d []byte) (int, error) {
-	e, err := u.buf.Write(d)
-	if e > 0 {
-		u.pos += int64(e)
-	}
-	if err != nil {
-		return e, err
-	}
-	if u.buf.Len() >= u.maxLen {
-		err = u.sendBlock()
-		u.maxLen += uploadBlockLen
+	var n int
+	for len(d) > 0 {
+		// only buffer up to the current part size
+		partLen := u.nextPartLen()
+		l := partLen - int64(u.buf.Len())
+		if l > int64(len(d)) {
+			l = int64(len(d))
+		}
+
+		e, err := u.buf.Write(d[:l])
+		if e > 0 {
+			n += e
+			u.pos += int64(e)
+			d = d[e:]
+		}
+		if err != nil {
+			return n, err
+		}
+		if int64(u.buf.Len()) >= partLen {
+			if err := u.sendBlock(); err != nil {
+				return n, err
+			}
+		}
 	}
-	return e, err
+	return n, nil
 }
 
 func (u *Upload) sendBlock() error {
+	if err := u.start(); err != nil {
+		return err
+	}
+
+	partId := len(u.chunks) + 1
+	if partId > uploadMaxParts {
+		return ErrUploadTooLarge
+	}
+
 	// flush buffer now
 	buf := u.buf
 	u.committed += int64(buf.Len())
 	u.buf = &bytes.Buffer{}
-	partId := len(u.chunks) + 1
-	log.Printf("Performing chunk upload (%d bytes)", buf.Len())
-
-	if u.ContentType == "" {
-		// need to guess content type
-		// or we could set it to application/octet-stream and let the platform do the job
-		u.ContentType = http.DetectContentType(buf.Bytes())
-	}
+	log.Printf("Performing chunk upload (part %d, %d bytes)", partId, buf.Len())
 
 	if u.uploadId == "" {
 		// need to initialize upload with aws
@@ -189,3 +293,28 @@ func (u *Upload) sendBlock() error {
 
 	return nil
 }
+
+// Abort cancels the upload, releasing parts already sent to storage. The
+// upload must not be used afterwards.
+func (u *Upload) Abort() error {
+	if u.uploadId == "" {
+		// no multipart upload started, nothing stored yet
+		return nil
+	}
+	req, err := http.NewRequest("DELETE", u.awsUrl+"?uploadId="+url.QueryEscape(u.uploadId), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.awsReq(req, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		return fmt.Errorf("AWS request failed: %s", resp.Status)
+	}
+	u.uploadId = ""
+	u.chunks = nil
+	return nil
+}
@@ -0,0 +1,86 @@
+package oauth2
+
+import "testing"
+
+const mb = 1024 * 1024
+
+func TestSetSize(t *testing.T) {
+	// 5MB parts hold up to uploadMinPartLen*uploadMaxParts bytes, about 50GB
+	const limit = uploadMinPartLen * uploadMaxParts
+
+	tests := []struct {
+		name string
+		size int64
+		want int64
+	}{
+		{"empty", 0, 5 * mb},
+		{"small", 1, 5 * mb},
+		{"just under 50GB", limit - 1, 5 * mb},
+		{"50GB", limit, 5 * mb},
+		{"just over 50GB", limit + 1, 6 * mb},
+		{"exact 6MB parts", 6 * mb * uploadMaxParts, 6 * mb},
+		{"rounded up to 1MB", 6*mb*uploadMaxParts + 1, 7 * mb},
+		{"5TB", uploadMaxObjectLen, 525 * mb},
+	}
+
+	for _, tt := range tests {
+		u, _ := NewUpload(nil, "", nil)
+		if err := u.SetSize(tt.size); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := u.nextPartLen(); got != tt.want {
+			t.Errorf("%s: part length %d, want %d", tt.name, got, tt.want)
+		}
+		if u.partLen*uploadMaxParts < tt.size {
+			t.Errorf("%s: %d parts of %d bytes cannot hold %d bytes", tt.name, uploadMaxParts, u.partLen, tt.size)
+		}
+	}
+
+	u, _ := NewUpload(nil, "", nil)
+	if err := u.SetSize(uploadMaxObjectLen + 1); err != ErrUploadTooLarge {
+		t.Errorf("over 5TB: got %v, want %v", err, ErrUploadTooLarge)
+	}
+}
+
+func TestNextPartLen(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64 // -1 if unknown
+		pos    int64
+		chunks int
+		want   int64
+	}{
+		{"first part", -1, 0, 0, 5 * mb},
+		{"before doubling", -1, 0, 999, 5 * mb},
+		{"first doubling", -1, 0, 1000, 10 * mb},
+		{"second doubling", -1, 0, 2000, 20 * mb},
+		{"last part", -1, 0, 9999, 5 * mb << 9},
+		{"clamped to 5GB", -1, 0, 11000, 5 * 1024 * mb},
+		{"known size", 100, 50, 3000, 5 * mb},
+		{"client sent more than announced", 100, 200, 3000, 40 * mb},
+	}
+
+	for _, tt := range tests {
+		u, _ := NewUpload(nil, "", nil)
+		if tt.size >= 0 {
+			u.SetSize(tt.size)
+		}
+		u.pos = tt.pos
+		u.chunks = make([]string, tt.chunks)
+		if got := u.nextPartLen(); got != tt.want {
+			t.Errorf("%s: part length %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// unknown size still reaches about 5TB within the part limit
+	u, _ := NewUpload(nil, "", nil)
+	var total int64
+	for len(u.chunks) < uploadMaxParts {
+		total += u.nextPartLen()
+		u.chunks = append(u.chunks, "")
+	}
+	if total < uploadMaxObjectLen/10*9 {
+		t.Errorf("unknown size reaches only %d bytes in %d parts", total, uploadMaxParts)
+	}
+}